@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ConfigChecker validates a config file and collects every error found with
+// the line number of the offending entry.
+type ConfigChecker struct {
+	Filename string
+	Errors   []string
+
+	lines map[string]int
+	ports map[int]string
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+
+var strictErrorRegexp = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// CheckConfig parses filename in strict mode and validates all entries, it
+// returns the errors sorted by line number.
+func CheckConfig(filename string) []string {
+	cc := &ConfigChecker{
+		Filename: filename,
+		lines:    make(map[string]int),
+		ports:    make(map[int]string),
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return []string{fmt.Sprintf("%s: %v", filename, err)}
+	}
+	if len(root.Content) > 0 {
+		cc.walk("", root.Content[0])
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		terr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v", filename, err)}
+		}
+		for _, s := range terr.Errors {
+			if m := strictErrorRegexp.FindStringSubmatch(s); m != nil {
+				line, _ := strconv.Atoi(m[1])
+				cc.Errors = append(cc.Errors, fmt.Sprintf("%s:%d: %s", filename, line, m[2]))
+			} else {
+				cc.Errors = append(cc.Errors, fmt.Sprintf("%s: %s", filename, s))
+			}
+		}
+	}
+
+	if err := config.LoadSecrets(); err != nil {
+		cc.errorf("secrets_file", "%v", err)
+	}
+
+	cc.Check(config)
+
+	sort.SliceStable(cc.Errors, func(i, j int) bool {
+		return errorLine(cc.Errors[i]) < errorLine(cc.Errors[j])
+	})
+
+	return cc.Errors
+}
+
+func errorLine(s string) int {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 3 {
+		return 0
+	}
+	line, _ := strconv.Atoi(parts[1])
+	return line
+}
+
+// walk records the line of every mapping key and sequence item by its path,
+// e.g. forward[1].local
+func (cc *ConfigChecker) walk(path string, node *yamlv3.Node) {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			cc.lines[key] = node.Content[i].Line
+			cc.walk(key, node.Content[i+1])
+		}
+	case yamlv3.SequenceNode:
+		for i, item := range node.Content {
+			key := fmt.Sprintf("%s[%d]", path, i)
+			cc.lines[key] = item.Line
+			cc.walk(key, item)
+		}
+	}
+}
+
+func (cc *ConfigChecker) errorf(path string, format string, args ...interface{}) {
+	line, ok := cc.lines[path]
+	for p := path; !ok && p != ""; {
+		if i := strings.LastIndexAny(p, ".["); i > 0 {
+			p = p[:i]
+		} else {
+			p = ""
+		}
+		line, ok = cc.lines[p]
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if ok {
+		cc.Errors = append(cc.Errors, fmt.Sprintf("%s:%d: %s: %s", cc.Filename, line, path, msg))
+	} else {
+		cc.Errors = append(cc.Errors, fmt.Sprintf("%s: %s: %s", cc.Filename, path, msg))
+	}
+}
+
+func (cc *ConfigChecker) Check(config *Config) {
+	if config.LabelsMode != "" && config.LabelsMode != LabelsModeInject && config.LabelsMode != LabelsModeInfo {
+		cc.errorf("labels_mode", "unknown labels_mode %#v, must be %s or %s", config.LabelsMode, LabelsModeInject, LabelsModeInfo)
+	}
+	cc.checkLabels("default_labels", config.DefaultLabels)
+
+	for i, s := range config.Exporter {
+		path := fmt.Sprintf("exporter[%d]", i)
+		cc.checkSsh(config, path, s.Host, s.Port, s.User, s.Pass, s.PassFile, s.Key)
+		if s.Local != 0 || !s.Pushes() {
+			cc.checkLocal(path+".local", s.Local)
+		}
+		cc.checkFile(path+".script", s.Script)
+		cc.checkLabels(path+".labels", s.Labels)
+		cc.checkCollect(path, s)
+		cc.checkPush(path, s)
+		for j, port := range s.TcpstatPorts {
+			if port <= 0 || port > 65535 {
+				cc.errorf(fmt.Sprintf("%s.tcpstat_ports[%d]", path, j), "invalid port %d", port)
+			}
+		}
+		cc.checkDuration(path+".smartctl_interval", s.SmartctlInterval)
+		names := make(map[string]bool)
+		for j, u := range s.Exporters {
+			upath := fmt.Sprintf("%s.exporters[%d]", path, j)
+			switch {
+			case u.Name == "":
+				cc.errorf(upath+".name", "name is empty")
+			case names[u.Name]:
+				cc.errorf(upath+".name", "duplicate name %#v", u.Name)
+			}
+			names[u.Name] = true
+			if v, err := url.Parse(u.URL); err != nil || v.Host == "" {
+				cc.errorf(upath+".url", "invalid url %#v", u.URL)
+			}
+			if u.Mode != "" && u.Mode != UpstreamModeMerge && u.Mode != UpstreamModeProxy {
+				cc.errorf(upath+".mode", "unknown mode %#v, must be %s or %s", u.Mode, UpstreamModeMerge, UpstreamModeProxy)
+			}
+		}
+	}
+
+	for i, s := range config.Discovery {
+		path := fmt.Sprintf("discovery[%d]", i)
+		switch {
+		case len(s.Files) == 0 && s.URL == "":
+			cc.errorf(path, "neither files nor url is set")
+		case len(s.Files) > 0 && s.URL != "":
+			cc.errorf(path, "files and url are exclusive")
+		}
+		for j, pattern := range s.Files {
+			if _, err := filepath.Glob(pattern); err != nil {
+				cc.errorf(fmt.Sprintf("%s.files[%d]", path, j), "invalid pattern %#v", pattern)
+			}
+		}
+		if s.URL != "" {
+			if v, err := url.Parse(s.URL); err != nil || v.Host == "" {
+				cc.errorf(path+".url", "invalid url %#v", s.URL)
+			}
+		}
+		if s.Host != "" {
+			cc.errorf(path+".host", "host is set by the discovered targets")
+		}
+		if s.Local != 0 {
+			cc.errorf(path+".local", "local is allocated from local_ports")
+		}
+		if _, _, err := ParsePortRange(s.LocalPorts); err != nil {
+			cc.errorf(path+".local_ports", "%v", err)
+		}
+		cc.checkDuration(path+".refresh_interval", s.RefreshInterval)
+		cc.checkSsh(config, path, "localhost", s.Port, s.User, s.Pass, s.PassFile, s.Key)
+		cc.checkFile(path+".script", s.Script)
+		cc.checkLabels(path+".labels", s.Labels)
+		cc.checkCollect(path, s.ExporterConfig)
+		cc.checkPush(path, s.ExporterConfig)
+	}
+
+	for i, s := range config.Forward {
+		path := fmt.Sprintf("forward[%d]", i)
+		cc.checkSsh(config, path, s.Host, s.Port, s.User, s.Pass, s.PassFile, s.Key)
+		if s.LocalSocket == "" {
+			cc.checkLocal(path+".local", s.Local)
+		} else if s.Local != 0 {
+			cc.errorf(path+".local_socket", "local and local_socket are exclusive")
+		}
+		if s.Remote == "" {
+			cc.errorf(path+".remote", "remote is empty")
+		}
+		if s.LocalSocketMode != "" {
+			if _, err := strconv.ParseUint(s.LocalSocketMode, 8, 32); err != nil {
+				cc.errorf(path+".local_socket_mode", "invalid octal mode %#v", s.LocalSocketMode)
+			}
+		}
+		cc.checkForward(path, s.Metrics, s.MaxConnections, s.IdleTimeout)
+	}
+
+	for i, s := range config.Reverse {
+		path := fmt.Sprintf("reverse[%d]", i)
+		cc.checkSsh(config, path, s.Host, s.Port, s.User, s.Pass, s.PassFile, s.Key)
+		if s.Remote == "" {
+			cc.errorf(path+".remote", "remote is empty")
+		}
+		if s.Local == "" {
+			cc.errorf(path+".local", "local is empty")
+		}
+		cc.checkForward(path, s.Metrics, s.MaxConnections, s.IdleTimeout)
+	}
+
+	for i, s := range config.Socks {
+		path := fmt.Sprintf("socks[%d]", i)
+		cc.checkSsh(config, path, s.Host, s.Port, s.User, s.Pass, s.PassFile, s.Key)
+		cc.checkLocal(path+".local", s.Local)
+		cc.checkForward(path, s.Metrics, s.MaxConnections, s.IdleTimeout)
+		switch {
+		case s.Username != "" && s.PasswordFile == "":
+			cc.errorf(path+".password_file", "password_file is required with username")
+		case s.Username == "" && s.PasswordFile != "":
+			cc.errorf(path+".username", "username is required with password_file")
+		case s.PasswordFile != "":
+			if _, err := ioutil.ReadFile(s.PasswordFile); err != nil {
+				cc.errorf(path+".password_file", "%v", err)
+			}
+		}
+	}
+}
+
+func (cc *ConfigChecker) checkSsh(config *Config, path string, host string, port int, user, pass, passFile, key string) {
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{{"host", &host}, {"user", &user}, {"pass", &pass}, {"key", &key}} {
+		v, err := config.Expand(*field.value)
+		if err != nil {
+			cc.errorf(path+"."+field.name, "%v", err)
+			continue
+		}
+		*field.value = v
+	}
+
+	if passFile != "" {
+		if _, err := config.Password(pass, passFile); err != nil {
+			cc.errorf(path+".pass_file", "%v", err)
+		}
+	}
+
+	switch {
+	case host == "":
+		cc.errorf(path+".host", "host is empty")
+	case net.ParseIP(host) == nil && !hostnameRegexp.MatchString(host):
+		cc.errorf(path+".host", "invalid host %#v", host)
+	}
+
+	if port < 0 || port > 65535 {
+		cc.errorf(path+".port", "invalid port %d", port)
+	}
+
+	if key != "" {
+		data, err := ioutil.ReadFile(key)
+		if err != nil {
+			cc.errorf(path+".key", "%v", err)
+		} else if _, err := ssh.ParsePrivateKey(data); err != nil {
+			cc.errorf(path+".key", "unable to parse private key %s: %v", key, err)
+		}
+	} else if pass == "" && passFile == "" {
+		cc.errorf(path, "neither pass, pass_file nor key is set")
+	}
+}
+
+// checkLocal checks a local listening port and that it is not used by
+// another entry.
+func (cc *ConfigChecker) checkLocal(path string, port int) {
+	if port <= 0 || port > 65535 {
+		cc.errorf(path, "invalid port %d", port)
+		return
+	}
+
+	if other, ok := cc.ports[port]; ok {
+		cc.errorf(path, "port %d is already used by %s", port, other)
+		return
+	}
+
+	cc.ports[port] = path
+}
+
+func (cc *ConfigChecker) checkForward(path string, metrics, maxConnections int, idleTimeout string) {
+	if metrics != 0 {
+		cc.checkLocal(path+".metrics", metrics)
+	}
+	if maxConnections < 0 {
+		cc.errorf(path+".max_connections", "invalid max_connections %d", maxConnections)
+	}
+	cc.checkDuration(path+".idle_timeout", idleTimeout)
+}
+
+func (cc *ConfigChecker) checkFile(path string, filename string) {
+	if filename == "" {
+		return
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		cc.errorf(path, "%v", err)
+		return
+	}
+	f.Close()
+}
+
+func (cc *ConfigChecker) checkLabels(path string, labels map[string]string) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := ValidateLabels(map[string]string{name: labels[name]}); err != nil {
+			cc.errorf(path+"."+name, "%v", err)
+		}
+	}
+}
+
+func (cc *ConfigChecker) checkCollect(path string, s ExporterConfig) {
+	cc.checkDuration(path+".collect_interval", s.CollectInterval)
+	cc.checkDuration(path+".max_staleness", s.MaxStaleness)
+	if s.MaxStaleness != "" && s.CollectInterval == "" {
+		cc.errorf(path+".max_staleness", "max_staleness is set without collect_interval")
+	}
+
+	names := make([]string, 0, len(s.CollectorIntervals))
+	for name := range s.CollectorIntervals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		known := false
+		for _, c := range Collectors {
+			known = known || c.Name == name
+		}
+		if !known {
+			cc.errorf(path+".collector_intervals."+name, "unknown collector %#v", name)
+		}
+		cc.checkDuration(path+".collector_intervals."+name, s.CollectorIntervals[name])
+	}
+}
+
+func (cc *ConfigChecker) checkPush(path string, s ExporterConfig) {
+	if rw := s.RemoteWrite; rw != nil {
+		cc.checkURL(path+".remote_write.url", rw.URL)
+		cc.checkAuth(path+".remote_write", rw.HTTPAuth)
+		if rw.WALMaxBytes < 0 {
+			cc.errorf(path+".remote_write.wal_max_bytes", "invalid wal_max_bytes %d", rw.WALMaxBytes)
+		}
+	}
+
+	if pg := s.Pushgateway; pg != nil {
+		cc.checkURL(path+".pushgateway.url", pg.URL)
+		cc.checkAuth(path+".pushgateway", pg.HTTPAuth)
+	}
+
+	if db := s.InfluxDB; db != nil {
+		if strings.HasPrefix(db.URL, "udp://") {
+			cc.checkAddress(path+".influxdb.url", strings.TrimPrefix(db.URL, "udp://"))
+		} else {
+			cc.checkURL(path+".influxdb.url", db.URL)
+		}
+		cc.checkAuth(path+".influxdb", db.HTTPAuth)
+		cc.checkFile(path+".influxdb.token_file", db.TokenFile)
+		if db.TokenFile != "" && db.BearerTokenFile != "" {
+			cc.errorf(path+".influxdb.token_file", "token_file and bearer_token_file are exclusive")
+		}
+	}
+
+	if g := s.Graphite; g != nil {
+		cc.checkAddress(path+".graphite.address", g.Address)
+		cc.checkTemplate(path+".graphite.template", g.Template)
+	}
+
+	if sd := s.StatsD; sd != nil {
+		cc.checkAddress(path+".statsd.address", sd.Address)
+		cc.checkTemplate(path+".statsd.template", sd.Template)
+	}
+
+	if o := s.OTLP; o != nil {
+		cc.checkURL(path+".otlp.endpoint", o.Endpoint)
+		cc.checkAuth(path+".otlp", o.HTTPAuth)
+	}
+}
+
+func (cc *ConfigChecker) checkAddress(path string, s string) {
+	if host, port, err := net.SplitHostPort(s); err != nil || host == "" || port == "" {
+		cc.errorf(path, "invalid address %#v", s)
+	}
+}
+
+func (cc *ConfigChecker) checkTemplate(path string, s string) {
+	if s == "" {
+		return
+	}
+
+	if err := CheckGraphiteTemplate(s); err != nil {
+		cc.errorf(path, "%v", err)
+	}
+}
+
+func (cc *ConfigChecker) checkURL(path string, s string) {
+	if v, err := url.Parse(s); err != nil || v.Host == "" || (v.Scheme != "http" && v.Scheme != "https") {
+		cc.errorf(path, "invalid url %#v", s)
+	}
+}
+
+func (cc *ConfigChecker) checkAuth(path string, auth HTTPAuth) {
+	cc.checkFile(path+".bearer_token_file", auth.BearerTokenFile)
+	if auth.Username != "" && auth.PasswordFile == "" {
+		cc.errorf(path+".password_file", "username is set without password_file")
+	}
+	cc.checkFile(path+".password_file", auth.PasswordFile)
+}
+
+func (cc *ConfigChecker) checkDuration(path string, s string) {
+	if s == "" {
+		return
+	}
+
+	if d, err := time.ParseDuration(s); err != nil || d < 0 {
+		cc.errorf(path, "invalid duration %#v", s)
+	}
+}
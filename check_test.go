@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name: "valid",
+			config: `exporter:
+  - host: web1.example.com
+    user: root
+    pass: secret
+    local: 10001
+`,
+			want: []string{},
+		},
+		{
+			name: "invalid",
+			config: `exporter:
+  - host: web1.example.com
+    user: root
+    pass: secret
+    local: 10001
+    scritp: collect.sh
+  - host: "web 2"
+    port: 70000
+    user: root
+    key: /nonexistent/id_rsa
+    local: 10001
+forward:
+  - host: db1
+    user: root
+    pass: secret
+    local: 10002
+    remote: 127.0.0.1:3306
+    idle_timeout: 5 minutes
+socks:
+  - host: db1
+    user: root
+    pass: secret
+    local: 10002
+    username: alice
+labels_mode: tags
+`,
+			want: []string{
+				`config.yml:6: field scritp not found in type main.ExporterConfig`,
+				`config.yml:7: exporter[1].host: invalid host "web 2"`,
+				`config.yml:8: exporter[1].port: invalid port 70000`,
+				`config.yml:10: exporter[1].key: open /nonexistent/id_rsa: no such file or directory`,
+				`config.yml:11: exporter[1].local: port 10001 is already used by exporter[0].local`,
+				`config.yml:18: forward[0].idle_timeout: invalid duration "5 minutes"`,
+				`config.yml:20: socks[0].password_file: password_file is required with username`,
+				`config.yml:23: socks[0].local: port 10002 is already used by forward[0].local`,
+				`config.yml:25: labels_mode: unknown labels_mode "tags", must be inject or info`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "remote_node_exporter_config")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString(c.config)
+			f.Close()
+
+			got := make([]string, 0)
+			for _, s := range CheckConfig(f.Name()) {
+				got = append(got, strings.Replace(s, f.Name(), "config.yml", 1))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("CheckConfig() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(c.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/common/log"
+)
+
+// DiscoveryConfig is a source of exporter targets, either prometheus file_sd
+// files or a http sd endpoint. The inline exporter settings are the defaults
+// of every discovered target, and local listening ports are allocated from
+// LocalPorts.
+type DiscoveryConfig struct {
+	Files           []string
+	URL             string
+	RefreshInterval string `yaml:"refresh_interval"`
+	LocalPorts      string `yaml:"local_ports"`
+
+	ExporterConfig `yaml:",inline"`
+}
+
+// TargetGroup is the prometheus file_sd and http sd format.
+type TargetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels,omitempty"`
+}
+
+var DefaultRefreshInterval = time.Minute
+
+func (s *DiscoveryConfig) Name() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return strings.Join(s.Files, ",")
+}
+
+func (s *DiscoveryConfig) Interval() time.Duration {
+	if d, err := time.ParseDuration(s.RefreshInterval); err == nil && d > 0 {
+		return d
+	}
+	return DefaultRefreshInterval
+}
+
+// ParsePortRange parses a port range like 20000-20999.
+func ParsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %#v", s)
+	}
+
+	first, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || first <= 0 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %#v", s)
+	}
+
+	return first, last, nil
+}
+
+func ParseTargetGroups(data []byte) ([]TargetGroup, error) {
+	groups := make([]TargetGroup, 0)
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (s *DiscoveryConfig) readFiles() ([]TargetGroup, error) {
+	groups := make([]TargetGroup, 0)
+	for _, pattern := range s.Files {
+		filenames, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			g, err := ParseTargetGroups(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", filename, err)
+			}
+			groups = append(groups, g...)
+		}
+	}
+	return groups, nil
+}
+
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+func (s *DiscoveryConfig) fetch() ([]TargetGroup, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Prometheus-Refresh-Interval-Seconds", strconv.Itoa(int(s.Interval().Seconds())))
+
+	resp, err := discoveryClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", s.URL, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTargetGroups(data)
+}
+
+// Discovery keeps the last targets of every source so that a failing http
+// endpoint does not remove its targets, and the local ports of targets so
+// that they are stable across reloads.
+type Discovery struct {
+	groups map[string][]TargetGroup
+	ports  map[string]int
+}
+
+// Discover appends the targets of all discovery sources to config.Exporter.
+func (d *Discovery) Discover(config *Config) error {
+	if d.groups == nil {
+		d.groups = make(map[string][]TargetGroup)
+		d.ports = make(map[string]int)
+	}
+
+	used := make(map[int]bool)
+	for _, s := range config.Exporter {
+		used[s.Local] = true
+	}
+	for _, s := range config.Forward {
+		used[s.Local], used[s.Metrics] = true, true
+	}
+	for _, s := range config.Reverse {
+		used[s.Metrics] = true
+	}
+	for _, s := range config.Socks {
+		used[s.Local], used[s.Metrics] = true, true
+	}
+
+	type target struct {
+		key    string
+		config ExporterConfig
+	}
+
+	ports := make(map[string]int)
+	for _, s := range config.Discovery {
+		first, last, err := ParsePortRange(s.LocalPorts)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.Name(), err)
+		}
+
+		var groups []TargetGroup
+		if s.URL != "" {
+			groups, err = s.fetch()
+		} else {
+			groups, err = s.readFiles()
+		}
+		if err != nil {
+			groups = d.groups[s.Name()]
+			log.Errorf("discovery %s error: %+v, keeping %d target groups\n", s.Name(), err, len(groups))
+		}
+		d.groups[s.Name()] = groups
+
+		targets := make([]target, 0)
+		seen := make(map[string]bool)
+		for _, g := range groups {
+			// invalid labels like __meta_* are dropped instead of failing
+			// every target of the source
+			labels := make(map[string]string)
+			for k, v := range g.Labels {
+				if err := ValidateLabels(map[string]string{k: v}); err != nil {
+					log.Infof("discovery %s: dropping label %s of %v: %v\n", s.Name(), k, g.Targets, err)
+					continue
+				}
+				labels[k] = v
+			}
+
+			for _, addr := range g.Targets {
+				t := target{config: s.ExporterConfig}
+				t.config.Host = addr
+				if host, port, err := net.SplitHostPort(addr); err == nil {
+					t.config.Host = host
+					t.config.Port, _ = strconv.Atoi(port)
+				}
+				t.key = fmt.Sprintf("%s|%s:%d", s.Name(), t.config.Host, t.config.Port)
+				if seen[t.key] {
+					continue
+				}
+				seen[t.key] = true
+
+				t.config.Labels = make(map[string]string)
+				for k, v := range s.Labels {
+					t.config.Labels[k] = v
+				}
+				for k, v := range labels {
+					t.config.Labels[k] = v
+				}
+
+				targets = append(targets, t)
+			}
+		}
+
+		sort.Slice(targets, func(i, j int) bool {
+			return targets[i].key < targets[j].key
+		})
+
+		// targets keep their previous port, new targets get the lowest free one
+		for _, t := range targets {
+			if port, ok := d.ports[t.key]; ok && port >= first && port <= last && !used[port] {
+				ports[t.key] = port
+				used[port] = true
+			}
+		}
+		for _, t := range targets {
+			if _, ok := ports[t.key]; ok {
+				continue
+			}
+			for port := first; port <= last; port++ {
+				if !used[port] {
+					ports[t.key] = port
+					used[port] = true
+					break
+				}
+			}
+			if _, ok := ports[t.key]; !ok {
+				return fmt.Errorf("%s: local_ports %s exhausted by %d targets", s.Name(), s.LocalPorts, len(targets))
+			}
+		}
+
+		for _, t := range targets {
+			t.config.Local = ports[t.key]
+			config.Exporter = append(config.Exporter, t.config)
+		}
+	}
+
+	d.ports = ports
+
+	return nil
+}
+
+// TargetGroups returns a target group for every exporter child, the scrape
+// address is SDHost with the local port of the exporter.
+func (m *Master) TargetGroups() []TargetGroup {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.targetGroups()
+}
+
+func (m *Master) targetGroups() []TargetGroup {
+	children := make([]*Child, 0, len(m.children))
+	for _, c := range m.children {
+		if c.Local != 0 {
+			children = append(children, c)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Local < children[j].Local
+	})
+
+	groups := make([]TargetGroup, 0, len(children))
+	for _, c := range children {
+		labels := map[string]string{"instance": c.Instance}
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		groups = append(groups, TargetGroup{
+			Targets: []string{net.JoinHostPort(m.SDHost, strconv.Itoa(c.Local))},
+			Labels:  labels,
+		})
+	}
+
+	return groups
+}
+
+// WriteSDFile writes groups to filename in file_sd format if they changed,
+// the file is replaced by rename so that prometheus never reads a partial
+// file.
+func WriteSDFile(filename string, groups []TargetGroup) error {
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if old, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// HandleSD serves the targets in prometheus http sd format.
+func (m *Master) HandleSD(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(m.TargetGroups())
+}
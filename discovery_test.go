@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "targets.yml")
+	discover := func(d *Discovery, targets string) ([]string, error) {
+		if err := ioutil.WriteFile(filename, []byte(targets), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		config := &Config{
+			Exporter: []ExporterConfig{{Host: "static", Local: 20001}},
+			Discovery: []DiscoveryConfig{{
+				Files:          []string{filepath.Join(dir, "*.yml")},
+				LocalPorts:     "20000-20003",
+				ExporterConfig: ExporterConfig{User: "root", Labels: map[string]string{"site": "dc1"}},
+			}},
+		}
+		if err := d.Discover(config); err != nil {
+			return nil, err
+		}
+
+		got := make([]string, 0)
+		for _, s := range config.Exporter[1:] {
+			got = append(got, fmt.Sprintf("%s:%d %d %v", s.Host, s.Port, s.Local, s.Labels))
+		}
+		return got, nil
+	}
+
+	d := &Discovery{}
+
+	// ports are allocated in the order of the targets, skipping static ones,
+	// and invalid labels are dropped
+	got, err := discover(d, `
+- targets: [web2, web1:2222]
+  labels:
+    role: web
+    __meta_filepath: targets.yml
+    device: sda
+`)
+	if err != nil {
+		t.Fatalf("Discover() error: %+v", err)
+	}
+	want := []string{
+		"web1:2222 20000 map[role:web site:dc1]",
+		"web2:0 20002 map[role:web site:dc1]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Discover() = %q, want %q", got, want)
+	}
+
+	// targets keep their port across refreshes, new ones get the lowest free
+	got, err = discover(d, `
+- targets: [web0, web2, web3]
+`)
+	if err != nil {
+		t.Fatalf("Discover() error: %+v", err)
+	}
+	want = []string{
+		"web0:0 20000 map[site:dc1]",
+		"web2:0 20002 map[site:dc1]",
+		"web3:0 20003 map[site:dc1]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Discover() = %q, want %q", got, want)
+	}
+
+	if _, err := discover(d, `
+- targets: [web0, web2, web3, web4]
+`); err == nil {
+		t.Errorf("Discover() allocated more ports than local_ports has")
+	}
+}
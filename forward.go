@@ -0,0 +1,579 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/prometheus/common/log"
+)
+
+// ForwardStats counts the connections and traffic of the forward served by
+// this process.
+type ForwardStats struct {
+	Active       int64
+	Total        int64
+	Rejected     int64
+	IdleClosed   int64
+	DialFailures int64
+	DialCount    int64
+	DialNanos    int64
+	SentBytes    int64
+	RecvBytes    int64
+}
+
+var Stats ForwardStats
+
+// accept reports whether a new connection is allowed by MaxConnections, the
+// caller must call release once an accepted connection is done.
+func (s *ForwardStats) accept() bool {
+	if n := atomic.AddInt64(&s.Active, 1); MaxConnections > 0 && n > MaxConnections {
+		atomic.AddInt64(&s.Active, -1)
+		atomic.AddInt64(&s.Rejected, 1)
+		return false
+	}
+	atomic.AddInt64(&s.Total, 1)
+	return true
+}
+
+func (s *ForwardStats) release() {
+	atomic.AddInt64(&s.Active, -1)
+}
+
+func (s *ForwardStats) dialed(start time.Time, err error) {
+	if err != nil {
+		atomic.AddInt64(&s.DialFailures, 1)
+		return
+	}
+	atomic.AddInt64(&s.DialCount, 1)
+	atomic.AddInt64(&s.DialNanos, int64(time.Since(start)))
+}
+
+// ServeForwardMetrics serves the forward statistics of this process on addr.
+func ServeForwardMetrics(client *Client, addr string, name string) error {
+	typ := ForwardType
+	if typ == "" {
+		typ = "local"
+	}
+	labels := fmt.Sprintf("forward=\"%s\",type=\"%s\"", name, typ)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		m := Metrics{Client: client}
+
+		m.PrintType("remote_node_exporter_forward_connections_active", "gauge", "Number of connections currently tunneled")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.Active))
+
+		m.PrintType("remote_node_exporter_forward_connections_total", "counter", "Total number of accepted connections")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.Total))
+
+		m.PrintType("remote_node_exporter_forward_connections_rejected_total", "counter", "Total number of connections rejected by max_connections")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.Rejected))
+
+		m.PrintType("remote_node_exporter_forward_connections_idle_closed_total", "counter", "Total number of connections closed by idle_timeout")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.IdleClosed))
+
+		m.PrintType("remote_node_exporter_forward_dial_failures_total", "counter", "Total number of failed dials to the other end of the tunnel")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.DialFailures))
+
+		m.PrintType("remote_node_exporter_forward_sent_bytes_total", "counter", "Total bytes sent from the local side to the remote side")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.SentBytes))
+
+		m.PrintType("remote_node_exporter_forward_received_bytes_total", "counter", "Total bytes received from the remote side to the local side")
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.RecvBytes))
+
+		m.name = "remote_node_exporter_forward_dial_duration_seconds"
+		m.PrintType(m.name, "summary", "Time spent to open a connection through the tunnel")
+		m.name = "remote_node_exporter_forward_dial_duration_seconds_sum"
+		m.PrintFloat(labels, time.Duration(atomic.LoadInt64(&Stats.DialNanos)).Seconds())
+		m.name = "remote_node_exporter_forward_dial_duration_seconds_count"
+		m.PrintInt(labels, atomic.LoadInt64(&Stats.DialCount))
+
+		if rtt := client.RTT(); rtt > 0 {
+			m.PrintType("remote_node_exporter_forward_ssh_rtt_seconds", "gauge", "Round trip time of the last ssh keepalive")
+			m.PrintFloat(labels, rtt.Seconds())
+		}
+
+		io.WriteString(rw, m.body.String())
+	})
+
+	return ListenAndServeWeb(addr, mux)
+}
+
+// ServeForward listens on laddr and tunnels every accepted connection to
+// raddr through the shared ssh connection of client.
+func ServeForward(client *Client, laddr string, raddr string) error {
+	return serve(laddr, func(conn net.Conn) {
+		Forward(client, conn, raddr)
+	})
+}
+
+// ServeSocks listens on laddr as a SOCKS5 server and dials every requested
+// destination from the remote host, like `ssh -D`.
+func ServeSocks(client *Client, laddr string) error {
+	return serve(laddr, func(conn net.Conn) {
+		Socks(client, conn)
+	})
+}
+
+// ParseAddr splits addr into network and address, unix sockets are written
+// as unix:///path/to/socket or as an absolute path.
+func ParseAddr(addr string) (string, string) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://")
+	}
+	return "tcp", addr
+}
+
+// listen listens on addr, a stale unix socket file is removed and the new one
+// is created with LocalSocketMode, it is removed again when the process is
+// terminated.
+func listen(addr string) (net.Listener, error) {
+	network, address := ParseAddr(addr)
+
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+
+	var ln net.Listener
+	var err error
+	if LocalSocketMode != 0 {
+		ln, err = listenUnix(address, LocalSocketMode)
+	} else {
+		ln, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-c
+		os.Remove(address)
+		signal.Reset(sig)
+		syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	}()
+
+	return ln, nil
+}
+
+// listenUnix binds the socket in a private directory and moves it to address
+// after chmod, so it is never accessible with a wider mode and the umask of
+// the process is left alone.
+func listenUnix(address string, mode os.FileMode) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(address), ".remote_node_exporter")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(address))
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode.Perm()); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, address); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+func serve(laddr string, handle func(net.Conn)) error {
+	ln, err := listen(laddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Infof("%T.Accept() error: %+v\n", ln, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !Stats.accept() {
+			log.Infof("%T.Accept() reject %s, max_connections %d reached\n", ln, conn.RemoteAddr(), MaxConnections)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer Stats.release()
+			handle(conn)
+		}()
+	}
+}
+
+func Forward(client *Client, lconn net.Conn, raddr string) {
+	defer lconn.Close()
+
+	start := time.Now()
+	rconn, err := client.Dial(ParseAddr(raddr))
+	Stats.dialed(start, err)
+	if err != nil {
+		log.Infof("%T.Dial(%#v) error: %+v\n", client, raddr, err)
+		return
+	}
+	defer rconn.Close()
+
+	Pipe(lconn, rconn)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type countWriter struct {
+	w      io.Writer
+	n      *int64
+	active *int64
+}
+
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	atomic.StoreInt64(cw.active, time.Now().UnixNano())
+	return n, err
+}
+
+// Pipe copies data between the local and remote connections in both
+// directions, a half-close on one side is propagated to the other so that
+// both directions can drain. Both are closed once idle for IdleTimeout.
+func Pipe(lconn, rconn net.Conn) {
+	done := make(chan struct{}, 2)
+	active := time.Now().UnixNano()
+
+	cp := func(dst, src net.Conn, n *int64) {
+		io.Copy(countWriter{dst, n, &active}, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+
+	go cp(rconn, lconn, &Stats.SentBytes)
+	go cp(lconn, rconn, &Stats.RecvBytes)
+
+	var idle <-chan time.Time
+	if IdleTimeout > 0 {
+		ticker := time.NewTicker(IdleTimeout / 4)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	for i := 0; i < 2; {
+		select {
+		case <-done:
+			i++
+		case <-idle:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&active))) > IdleTimeout {
+				log.Infof("Pipe(%s, %s) idle for %s, closing\n", lconn.RemoteAddr(), rconn.RemoteAddr(), IdleTimeout)
+				atomic.AddInt64(&Stats.IdleClosed, 1)
+				lconn.Close()
+				rconn.Close()
+				idle = nil
+			}
+		}
+	}
+}
+
+// Listen asks the remote sshd to listen on addr, the listener is closed when
+// the ssh connection is lost. Unix sockets are requested with
+// streamlocal-forward@openssh.com.
+func (c *Client) Listen(network, addr string) (net.Listener, error) {
+	client, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Listen(network, addr)
+}
+
+// ServeReverse asks the remote sshd to listen on raddr and tunnels every
+// incoming connection back to laddr, the remote listener is re-established
+// after the ssh connection is lost.
+func ServeReverse(client *Client, raddr string, laddr string) {
+	delay := time.Second
+	for {
+		ln, err := client.Listen(ParseAddr(raddr))
+		if err != nil {
+			log.Infof("%T.Listen(%#v) error: %+v, retry in %s\n", client, raddr, err, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > time.Minute {
+				delay = time.Minute
+			}
+			continue
+		}
+		log.Infof("%T.Listen(%#v) ok, tunneling to %#v\n", client, raddr, laddr)
+		delay = time.Second
+
+		for {
+			rconn, err := ln.Accept()
+			if err != nil {
+				log.Infof("%T.Accept() error: %+v\n", ln, err)
+				break
+			}
+			if !Stats.accept() {
+				log.Infof("%T.Accept() reject %s, max_connections %d reached\n", ln, rconn.RemoteAddr(), MaxConnections)
+				rconn.Close()
+				continue
+			}
+			go func() {
+				defer Stats.release()
+				Reverse(rconn, laddr)
+			}()
+		}
+
+		ln.Close()
+		time.Sleep(delay)
+	}
+}
+
+func Reverse(rconn net.Conn, laddr string) {
+	defer rconn.Close()
+
+	network, address := ParseAddr(laddr)
+	start := time.Now()
+	lconn, err := net.DialTimeout(network, address, 8*time.Second)
+	Stats.dialed(start, err)
+	if err != nil {
+		log.Infof("net.Dial(%#v) error: %+v\n", laddr, err)
+		return
+	}
+	defer lconn.Close()
+
+	Pipe(lconn, rconn)
+}
+
+// https://tools.ietf.org/html/rfc1928
+const (
+	socksVersion = 0x05
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded         = 0x00
+	socksRepGeneralFailure    = 0x01
+	socksRepConnectionRefused = 0x05
+	socksRepCmdNotSupported   = 0x07
+	socksRepAtypNotSupported  = 0x08
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	// https://tools.ietf.org/html/rfc1929
+	socksUserPassVersion = 0x01
+	socksUserPassSuccess = 0x00
+	socksUserPassFailure = 0x01
+
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+func Socks(client *Client, lconn net.Conn) {
+	defer lconn.Close()
+
+	lconn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	addr, err := socksHandshake(lconn)
+	if err != nil {
+		log.Infof("%T.Socks(%s) handshake error: %+v\n", client, lconn.RemoteAddr(), err)
+		return
+	}
+
+	start := time.Now()
+	rconn, err := client.Dial("tcp", addr)
+	Stats.dialed(start, err)
+	if err != nil {
+		log.Infof("%T.Dial(%#v) error: %+v\n", client, addr, err)
+		rep := byte(socksRepGeneralFailure)
+		if _, ok := err.(*ssh.OpenChannelError); ok {
+			rep = socksRepConnectionRefused
+		}
+		socksReply(lconn, rep)
+		return
+	}
+	defer rconn.Close()
+
+	if err := socksReply(lconn, socksRepSucceeded); err != nil {
+		return
+	}
+	lconn.SetDeadline(time.Time{})
+
+	Pipe(lconn, rconn)
+}
+
+// socksMethod returns the auth method required from the client of conn,
+// username/password if SocksUser is set, otherwise no authentication which is
+// only allowed from loopback addresses.
+func socksMethod(conn net.Conn) byte {
+	if SocksUser != "" {
+		return socksMethodUserPass
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		return socksMethodNoAcceptable
+	}
+	return socksMethodNoAuth
+}
+
+// socksAuth reads a username/password request and checks it against SocksUser
+// and the content of SocksPassFile.
+func socksAuth(conn net.Conn) error {
+	var b [256]byte
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socksUserPassVersion {
+		return fmt.Errorf("unsupported socks auth version %d", b[0])
+	}
+	user := make([]byte, b[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, b[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return err
+	}
+
+	// the file is read every time so that the password can be changed
+	data, err := ioutil.ReadFile(SocksPassFile)
+	if err != nil {
+		conn.Write([]byte{socksUserPassVersion, socksUserPassFailure})
+		return err
+	}
+	expected := []byte(strings.TrimRight(string(data), "\r\n"))
+
+	if subtle.ConstantTimeCompare(user, []byte(SocksUser)) != 1 || subtle.ConstantTimeCompare(pass, expected) != 1 {
+		conn.Write([]byte{socksUserPassVersion, socksUserPassFailure})
+		return fmt.Errorf("socks auth failed for user %#v", string(user))
+	}
+
+	_, err = conn.Write([]byte{socksUserPassVersion, socksUserPassSuccess})
+	return err
+}
+
+// socksHandshake negotiates the auth method of socksMethod and reads a
+// CONNECT request, it returns the requested destination address.
+func socksHandshake(conn net.Conn) (string, error) {
+	var b [256]byte
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return "", err
+	}
+	if b[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", b[0])
+	}
+	methods := b[1]
+	if _, err := io.ReadFull(conn, b[:methods]); err != nil {
+		return "", err
+	}
+
+	required := socksMethod(conn)
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range b[:methods] {
+		if m == required {
+			method = required
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNoAcceptable {
+		return "", fmt.Errorf("no acceptable socks auth method")
+	}
+	if method == socksMethodUserPass {
+		if err := socksAuth(conn); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return "", err
+	}
+	if b[1] != socksCmdConnect {
+		socksReply(conn, socksRepCmdNotSupported)
+		return "", fmt.Errorf("unsupported socks command %d", b[1])
+	}
+
+	var host string
+	switch b[3] {
+	case socksAtypIPv4:
+		if _, err := io.ReadFull(conn, b[:net.IPv4len]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+	case socksAtypIPv6:
+		if _, err := io.ReadFull(conn, b[:net.IPv6len]); err != nil {
+			return "", err
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+	case socksAtypDomain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return "", err
+		}
+		n := b[0]
+		if _, err := io.ReadFull(conn, b[:n]); err != nil {
+			return "", err
+		}
+		host = string(b[:n])
+	default:
+		socksReply(conn, socksRepAtypNotSupported)
+		return "", fmt.Errorf("unsupported socks address type %d", b[3])
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(b[:2])
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// addrConn overrides the remote address of a net.Pipe end.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestSocksHandshake(t *testing.T) {
+	defer func(user, passFile string) {
+		SocksUser, SocksPassFile = user, passFile
+	}(SocksUser, SocksPassFile)
+
+	f, err := ioutil.TempFile("", "remote_node_exporter_socks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("s3cret\n")
+	f.Close()
+
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 40000}
+
+	userPass := func(user, pass string) []byte {
+		b := []byte{socksUserPassVersion, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		return append(b, pass...)
+	}
+	connect := []byte{socksVersion, socksCmdConnect, 0x00, socksAtypIPv4, 10, 0, 0, 1, 0, 80}
+
+	cases := []struct {
+		name    string
+		user    string
+		addr    net.Addr
+		request [][]byte
+		reply   []byte
+		want    string
+	}{
+		{
+			name:    "no auth from loopback",
+			addr:    loopback,
+			request: [][]byte{{socksVersion, 1, socksMethodNoAuth}, connect},
+			reply:   []byte{socksVersion, socksMethodNoAuth},
+			want:    "10.0.0.1:80",
+		},
+		{
+			name: "domain",
+			addr: loopback,
+			request: [][]byte{
+				{socksVersion, 1, socksMethodNoAuth},
+				{socksVersion, socksCmdConnect, 0x00, socksAtypDomain, 11},
+				[]byte("example.com"),
+				{0x01, 0xbb},
+			},
+			reply: []byte{socksVersion, socksMethodNoAuth},
+			want:  "example.com:443",
+		},
+		{
+			name: "ipv6",
+			addr: loopback,
+			request: [][]byte{
+				{socksVersion, 1, socksMethodNoAuth},
+				{socksVersion, socksCmdConnect, 0x00, socksAtypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+				{0x23, 0x8c},
+			},
+			reply: []byte{socksVersion, socksMethodNoAuth},
+			want:  "[2001:db8::1]:9100",
+		},
+		{
+			name:    "no auth from a remote address",
+			addr:    remote,
+			request: [][]byte{{socksVersion, 1, socksMethodNoAuth}, connect},
+			reply:   []byte{socksVersion, socksMethodNoAcceptable},
+		},
+		{
+			name:    "no auth with a user set",
+			user:    "alice",
+			addr:    loopback,
+			request: [][]byte{{socksVersion, 1, socksMethodNoAuth}, connect},
+			reply:   []byte{socksVersion, socksMethodNoAcceptable},
+		},
+		{
+			name:    "password",
+			user:    "alice",
+			addr:    remote,
+			request: [][]byte{{socksVersion, 2, socksMethodNoAuth, socksMethodUserPass}, userPass("alice", "s3cret"), connect},
+			reply:   []byte{socksVersion, socksMethodUserPass, socksUserPassVersion, socksUserPassSuccess},
+			want:    "10.0.0.1:80",
+		},
+		{
+			name:    "wrong password",
+			user:    "alice",
+			addr:    remote,
+			request: [][]byte{{socksVersion, 1, socksMethodUserPass}, userPass("alice", "secret"), connect},
+			reply:   []byte{socksVersion, socksMethodUserPass, socksUserPassVersion, socksUserPassFailure},
+		},
+		{
+			name:    "wrong user",
+			user:    "alice",
+			addr:    remote,
+			request: [][]byte{{socksVersion, 1, socksMethodUserPass}, userPass("bob", "s3cret"), connect},
+			reply:   []byte{socksVersion, socksMethodUserPass, socksUserPassVersion, socksUserPassFailure},
+		},
+		{
+			name:    "bind",
+			addr:    loopback,
+			request: [][]byte{{socksVersion, 1, socksMethodNoAuth}, {socksVersion, 0x02, 0x00, socksAtypIPv4, 10, 0, 0, 1, 0, 80}},
+			reply:   []byte{socksVersion, socksMethodNoAuth, socksVersion, socksRepCmdNotSupported, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:    "socks4",
+			addr:    loopback,
+			request: [][]byte{{0x04, socksCmdConnect, 0, 80, 10, 0, 0, 1, 0}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			SocksUser, SocksPassFile = c.user, f.Name()
+
+			client, server := net.Pipe()
+			defer client.Close()
+
+			go func() {
+				for _, b := range c.request {
+					if _, err := client.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+
+			var addr string
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				addr, err = socksHandshake(addrConn{server, c.addr})
+				server.Close()
+			}()
+
+			reply, _ := ioutil.ReadAll(client)
+			<-done
+
+			if !bytes.Equal(reply, c.reply) {
+				t.Errorf("socksHandshake() replied %v, want %v", reply, c.reply)
+			}
+			if c.want == "" {
+				if err == nil {
+					t.Errorf("socksHandshake() = %#v, want an error", addr)
+				}
+				return
+			}
+			if err != nil || addr != c.want {
+				t.Errorf("socksHandshake() = %#v, %+v, want %#v", addr, err, c.want)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	address := filepath.Join(dir, "node.sock")
+	ln, err := listenUnix(address, 0660)
+	if err != nil {
+		t.Fatalf("listenUnix() error: %+v", err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(address)
+	if err != nil {
+		t.Fatalf("os.Stat() error: %+v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode is %s, want 0660", fi.Mode())
+	}
+
+	// the private directory the socket was bound in is removed
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%s contains %d files, want 1", dir, len(files))
+	}
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("unix", address)
+	if err != nil {
+		t.Fatalf("net.Dial() error: %+v", err)
+	}
+	defer conn.Close()
+
+	if b, _ := ioutil.ReadAll(conn); string(b) != "ok" {
+		t.Errorf("read %q from the socket, want \"ok\"", b)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// DefaultGraphiteTemplate is the path template of graphite and statsd outputs.
+var DefaultGraphiteTemplate = "{instance}.{metric}"
+
+type GraphiteConfig struct {
+	// Address is the host:port of the plaintext protocol listener.
+	Address string `yaml:"address" json:"address"`
+
+	// Template is a dotted path like servers.{instance}.{metric}.{device},
+	// {metric} is the metric name and {name} the value of label name. A node
+	// with a missing label is dropped, labels not in the template except job
+	// are appended as name.value nodes.
+	Template string `yaml:"template" json:"template,omitempty"`
+}
+
+type StatsDConfig struct {
+	// Address is the host:port of the udp listener.
+	Address  string `yaml:"address" json:"address"`
+	Template string `yaml:"template" json:"template,omitempty"`
+}
+
+var Graphite *GraphiteConfig = func() *GraphiteConfig {
+	s := os.Getenv("GRAPHITE")
+	if s == "" {
+		return nil
+	}
+	config := &GraphiteConfig{}
+	if err := json.Unmarshal([]byte(s), config); err != nil {
+		log.Fatalf("unable to parse GRAPHITE %#v: %v", s, err)
+	}
+	return config
+}()
+
+var StatsD *StatsDConfig = func() *StatsDConfig {
+	s := os.Getenv("STATSD")
+	if s == "" {
+		return nil
+	}
+	config := &StatsDConfig{}
+	if err := json.Unmarshal([]byte(s), config); err != nil {
+		log.Fatalf("unable to parse STATSD %#v: %v", s, err)
+	}
+	return config
+}()
+
+var (
+	graphitePlaceholderRegexp = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+	graphiteNodeRegexp        = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+)
+
+// CheckGraphiteTemplate validates a graphite path template.
+func CheckGraphiteTemplate(template string) error {
+	if !strings.Contains(template, "{metric}") {
+		return fmt.Errorf("template %#v does not contain {metric}", template)
+	}
+	if s := graphitePlaceholderRegexp.ReplaceAllString(template, ""); strings.ContainsAny(s, "{} ") {
+		return fmt.Errorf("invalid template %#v", template)
+	}
+	for _, node := range strings.Split(template, ".") {
+		if node == "" {
+			return fmt.Errorf("empty node in template %#v", template)
+		}
+	}
+	return nil
+}
+
+// GraphitePath flattens a sample into a dotted path by template.
+func GraphitePath(template string, s Sample) string {
+	if template == "" {
+		template = DefaultGraphiteTemplate
+	}
+
+	used := map[string]bool{}
+	nodes := make([]string, 0)
+	for _, node := range strings.Split(template, ".") {
+		missing := false
+		node = graphitePlaceholderRegexp.ReplaceAllStringFunc(node, func(p string) string {
+			name := p[1 : len(p)-1]
+			used[name] = true
+			value := s.Name
+			if name != "metric" {
+				value = s.Label(name)
+			}
+			if value == "" {
+				missing = true
+			}
+			return graphiteNodeRegexp.ReplaceAllString(value, "_")
+		})
+		if !missing {
+			nodes = append(nodes, node)
+		}
+	}
+
+	// job is the same for every sample
+	used["job"] = true
+	for _, l := range s.Labels {
+		if !used[l.Name] && l.Value != "" {
+			nodes = append(nodes, graphiteNodeRegexp.ReplaceAllString(l.Name, "_"), graphiteNodeRegexp.ReplaceAllString(l.Value, "_"))
+		}
+	}
+
+	return strings.Join(nodes, ".")
+}
+
+// pushConn is a connection of a push output which is dialed on demand and
+// redialed after a write error.
+type pushConn struct {
+	Network string
+	Address string
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (c *pushConn) write(batches [][]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for retry := 0; ; retry++ {
+		n, err := c.writeOnce(batches)
+		if err == nil || retry > 0 {
+			return err
+		}
+		log.Errorf("%s %s error: %+v, reconnecting\n", c.Network, c.Address, err)
+		// the batches before the failed one are sent already
+		batches = batches[n:]
+	}
+}
+
+// writeOnce returns the number of batches written before an error.
+func (c *pushConn) writeOnce(batches [][]byte) (int, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout(c.Network, c.Address, 10*time.Second)
+		if err != nil {
+			return 0, err
+		}
+		c.conn = conn
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	for i, b := range batches {
+		if _, err := c.conn.Write(b); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return i, err
+		}
+	}
+
+	return len(batches), nil
+}
+
+// batchLines joins lines into batches of at most size bytes, a line is never
+// split.
+func batchLines(lines []string, size int) [][]byte {
+	batches := make([][]byte, 0)
+	var b bytes.Buffer
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+len(line)+1 > size {
+			batches = append(batches, append([]byte(nil), b.Bytes()...))
+			b.Reset()
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	if b.Len() > 0 {
+		batches = append(batches, b.Bytes())
+	}
+	return batches
+}
+
+// GraphiteSink writes samples in the graphite plaintext protocol over tcp.
+type GraphiteSink struct {
+	Config *GraphiteConfig
+
+	conn *pushConn
+}
+
+func NewGraphiteSink(config *GraphiteConfig) *GraphiteSink {
+	return &GraphiteSink{
+		Config: config,
+		conn:   &pushConn{Network: "tcp", Address: config.Address},
+	}
+}
+
+func (sink *GraphiteSink) Name() string {
+	return "graphite " + sink.Config.Address
+}
+
+// https://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-plaintext-protocol
+func (sink *GraphiteSink) Lines(samples []Sample, ts time.Time) []string {
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		lines = append(lines, GraphitePath(sink.Config.Template, s)+" "+strconv.FormatFloat(s.Value, 'g', -1, 64)+" "+strconv.FormatInt(ts.Unix(), 10))
+	}
+	return lines
+}
+
+func (sink *GraphiteSink) Write(samples []Sample, ts time.Time) error {
+	return sink.conn.write(batchLines(sink.Lines(samples, ts), 64*1024))
+}
+
+// StatsDSink writes samples as statsd gauges, counters are sent as the
+// increase since the previous collection.
+type StatsDSink struct {
+	Config *StatsDConfig
+
+	conn *pushConn
+	last map[string]float64
+}
+
+func NewStatsDSink(config *StatsDConfig) *StatsDSink {
+	return &StatsDSink{
+		Config: config,
+		conn:   &pushConn{Network: "udp", Address: config.Address},
+		last:   make(map[string]float64),
+	}
+}
+
+func (sink *StatsDSink) Name() string {
+	return "statsd " + sink.Config.Address
+}
+
+// cumulative reports whether a sample only increases, which are counters and
+// the buckets, sums and counts of histograms and summaries.
+func cumulative(s Sample) bool {
+	switch s.Type {
+	case "counter", "histogram":
+		return true
+	case "summary":
+		return s.Name != s.Family()
+	}
+	return false
+}
+
+// Lines returns the statsd lines of samples, counters are remembered for the
+// increase of the next call.
+// https://github.com/statsd/statsd/blob/master/docs/metric_types.md
+func (sink *StatsDSink) Lines(samples []Sample) []string {
+	lines := make([]string, 0, len(samples))
+	last := make(map[string]float64, len(sink.last))
+	for _, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		path := GraphitePath(sink.Config.Template, s)
+
+		if !cumulative(s) {
+			// a leading sign changes a gauge relatively
+			value := strconv.FormatFloat(s.Value, 'g', -1, 64)
+			if s.Value < 0 {
+				value = "0|g\n" + path + ":" + value
+			}
+			lines = append(lines, path+":"+value+"|g")
+			continue
+		}
+
+		last[path] = s.Value
+		prev, ok := sink.last[path]
+		if !ok {
+			continue
+		}
+		delta := s.Value - prev
+		if delta < 0 {
+			// counter reset
+			delta = s.Value
+		}
+		if delta > 0 {
+			lines = append(lines, path+":"+strconv.FormatFloat(delta, 'g', -1, 64)+"|c")
+		}
+	}
+	sink.last = last
+
+	sort.Strings(lines)
+
+	return lines
+}
+
+func (sink *StatsDSink) Write(samples []Sample, ts time.Time) error {
+	return sink.conn.write(batchLines(sink.Lines(samples), MaxUDPPayload))
+}
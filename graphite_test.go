@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGraphitePath(t *testing.T) {
+	cpu := Sample{
+		Name:   "node_cpu_seconds_total",
+		Labels: []Label{{"cpu", "0"}, {"instance", "web1.example.com"}, {"job", "node"}, {"mode", "idle"}},
+	}
+	fs := Sample{
+		Name:   "node_filesystem_avail_bytes",
+		Labels: []Label{{"device", "/dev/sda1"}, {"instance", "10.0.0.1:9100"}, {"mountpoint", "/var/lib/my data"}},
+	}
+
+	cases := []struct {
+		template string
+		sample   Sample
+		want     string
+	}{
+		{"", cpu, "web1_example_com.node_cpu_seconds_total.cpu.0.mode.idle"},
+		{"servers.{instance}.{metric}.{mode}", cpu, "servers.web1_example_com.node_cpu_seconds_total.idle.cpu.0"},
+		{"{instance}.{metric}.{device}", cpu, "web1_example_com.node_cpu_seconds_total.cpu.0.mode.idle"},
+		{"{instance}.{metric}.{device}", fs, "10_0_0_1_9100.node_filesystem_avail_bytes._dev_sda1.mountpoint._var_lib_my_data"},
+		{"{instance}.disk-{device}.{metric}", fs, "10_0_0_1_9100.disk-_dev_sda1.node_filesystem_avail_bytes.mountpoint._var_lib_my_data"},
+		{"", Sample{Name: "up"}, "up"},
+	}
+
+	for _, c := range cases {
+		if got := GraphitePath(c.template, c.sample); got != c.want {
+			t.Errorf("GraphitePath(%#v, %v) = %#v, want %#v", c.template, c.sample.Labels, got, c.want)
+		}
+	}
+}
+
+func TestCheckGraphiteTemplate(t *testing.T) {
+	cases := []struct {
+		template string
+		valid    bool
+	}{
+		{"{instance}.{metric}", true},
+		{"servers.{instance}.{metric}.{device}", true},
+		{"servers.{instance}", false},
+		{"servers..{metric}", false},
+		{"{instance} {metric}", false},
+		{"{instance}.{metric}.{9device}", false},
+	}
+
+	for _, c := range cases {
+		if err := CheckGraphiteTemplate(c.template); (err == nil) != c.valid {
+			t.Errorf("CheckGraphiteTemplate(%#v) = %v, want valid %v", c.template, err, c.valid)
+		}
+	}
+}
+
+func TestGraphiteLines(t *testing.T) {
+	sink := &GraphiteSink{Config: &GraphiteConfig{}}
+	samples := []Sample{
+		{Name: "node_load1", Labels: []Label{{"instance", "web1"}}, Value: 0.25},
+		{Name: "node_hwmon_temp_celsius", Labels: []Label{{"instance", "web1"}}, Value: math.NaN()},
+		{Name: "node_memory_MemTotal_bytes", Labels: []Label{{"instance", "web1"}}, Value: 8e9},
+	}
+
+	got := sink.Lines(samples, time.Unix(1600000000, 500e6))
+	want := []string{
+		"web1.node_load1 0.25 1600000000",
+		"web1.node_memory_MemTotal_bytes 8e+09 1600000000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() = %q, want %q", got, want)
+	}
+}
+
+func TestStatsDLines(t *testing.T) {
+	sink := &StatsDSink{Config: &StatsDConfig{Template: "{metric}"}, last: make(map[string]float64)}
+
+	collect := func(gauge, counter, sum float64) []string {
+		return sink.Lines([]Sample{
+			{Name: "node_temp", Type: "gauge", Value: gauge},
+			{Name: "node_intr_total", Type: "counter", Value: counter},
+			{Name: "rpc_seconds", Type: "summary", Labels: []Label{{"quantile", "0.5"}}, Value: 0.2},
+			{Name: "rpc_seconds_sum", Type: "summary", Value: sum},
+		})
+	}
+
+	cases := []struct {
+		gauge, counter, sum float64
+		want                []string
+	}{
+		// counters are sent from the second collection on
+		{20, 100, 1.5, []string{"node_temp:20|g", "rpc_seconds.quantile.0_5:0.2|g"}},
+		{-5, 150, 1.5, []string{"node_intr_total:50|c", "node_temp:0|g\nnode_temp:-5|g", "rpc_seconds.quantile.0_5:0.2|g"}},
+		// a reset sends the new value
+		{math.Inf(1), 30, 2, []string{"node_intr_total:30|c", "rpc_seconds.quantile.0_5:0.2|g", "rpc_seconds_sum:0.5|c"}},
+	}
+
+	for i, c := range cases {
+		if got := collect(c.gauge, c.counter, c.sum); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Lines() #%d = %q, want %q", i, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,991 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/common/log"
+)
+
+type ExporterConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Pass     string
+	PassFile string `yaml:"pass_file"`
+	Key      string
+	Local    int
+	Script   string
+
+	TcpstatPorts []int `yaml:"tcpstat_ports"`
+
+	Smartctl         bool
+	SmartctlSudo     bool   `yaml:"smartctl_sudo"`
+	SmartctlInterval string `yaml:"smartctl_interval"`
+
+	Exporters []Upstream
+
+	Labels map[string]string
+
+	CollectInterval    string            `yaml:"collect_interval"`
+	MaxStaleness       string            `yaml:"max_staleness"`
+	CollectorIntervals map[string]string `yaml:"collector_intervals"`
+
+	RemoteWrite *RemoteWriteConfig `yaml:"remote_write"`
+	Pushgateway *PushgatewayConfig `yaml:"pushgateway"`
+	InfluxDB    *InfluxDBConfig    `yaml:"influxdb"`
+	Graphite    *GraphiteConfig    `yaml:"graphite"`
+	StatsD      *StatsDConfig      `yaml:"statsd"`
+	OTLP        *OTLPConfig        `yaml:"otlp"`
+}
+
+// Pushes reports whether the exporter has a push output.
+func (s *ExporterConfig) Pushes() bool {
+	return s.RemoteWrite != nil || s.Pushgateway != nil || s.InfluxDB != nil || s.Graphite != nil || s.StatsD != nil || s.OTLP != nil
+}
+
+type ForwardConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Pass     string
+	PassFile string `yaml:"pass_file"`
+	Key      string
+	Local    int
+	Remote   string
+
+	LocalSocket     string `yaml:"local_socket"`
+	LocalSocketMode string `yaml:"local_socket_mode"`
+
+	Metrics        int
+	MaxConnections int    `yaml:"max_connections"`
+	IdleTimeout    string `yaml:"idle_timeout"`
+}
+
+type ReverseConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Pass     string
+	PassFile string `yaml:"pass_file"`
+	Key      string
+	Remote   string
+	Local    string
+
+	Metrics        int
+	MaxConnections int    `yaml:"max_connections"`
+	IdleTimeout    string `yaml:"idle_timeout"`
+}
+
+type SocksConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Pass     string
+	PassFile string `yaml:"pass_file"`
+	Key      string
+	Local    int
+
+	// Username and PasswordFile enable username/password auth of the socks
+	// clients, without them only loopback clients are accepted.
+	Username     string
+	PasswordFile string `yaml:"password_file"`
+
+	Metrics        int
+	MaxConnections int    `yaml:"max_connections"`
+	IdleTimeout    string `yaml:"idle_timeout"`
+}
+
+type Config struct {
+	Exporter []ExporterConfig
+	Forward  []ForwardConfig
+	Reverse  []ReverseConfig
+	Socks    []SocksConfig
+
+	Discovery []DiscoveryConfig
+
+	DefaultLabels map[string]string `yaml:"default_labels"`
+	LabelsMode    string            `yaml:"labels_mode"`
+
+	SecretsFile    string `yaml:"secrets_file"`
+	SecretsKeyFile string `yaml:"secrets_key_file"`
+
+	secrets map[string]string
+
+	// envSecrets are the environment variables referenced as ${NAME}
+	envSecrets map[string]bool
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	// unknown keys are only reported, check-config rejects them
+	if err := yaml.UnmarshalStrict(data, &Config{}); err != nil {
+		log.Errorf("%s: %+v, run check-config for details\n", filename, err)
+	}
+
+	if err = config.LoadSecrets(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// DefaultPushInterval is the collect interval of exporters with push outputs
+// and no collect_interval.
+var DefaultPushInterval = time.Minute
+
+// Children returns the child processes described by the config, every child
+// serves exactly one exporter or forward entry.
+func (config *Config) Children() ([]*Child, error) {
+	children := make([]*Child, 0)
+
+	if config.LabelsMode != "" && config.LabelsMode != LabelsModeInject && config.LabelsMode != LabelsModeInfo {
+		return nil, fmt.Errorf("unknown labels_mode %#v", config.LabelsMode)
+	}
+
+	for _, s := range config.Exporter {
+		pass, err := config.expandSsh(&s.Host, &s.User, &s.Key, s.Pass, s.PassFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s@%s: %v", s.User, s.Host, err)
+		}
+		if s.Host == "" {
+			return nil, fmt.Errorf("%s@%s: host is empty", s.User, s.Host)
+		}
+		if s.Port == 0 {
+			s.Port = 22
+		}
+		tcpstatPorts := make([]string, 0)
+		for _, port := range s.TcpstatPorts {
+			tcpstatPorts = append(tcpstatPorts, strconv.Itoa(port))
+		}
+		exporters, err := json.Marshal(s.Exporters)
+		if err != nil {
+			return nil, err
+		}
+		labels := make(map[string]string)
+		for k, v := range config.DefaultLabels {
+			labels[k] = v
+		}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		if err := ValidateLabels(labels); err != nil {
+			return nil, fmt.Errorf("%s@%s: %v", s.User, s.Host, err)
+		}
+		labelsJSON, err := json.Marshal(labels)
+		if err != nil {
+			return nil, err
+		}
+		collectorIntervals := make([]string, 0, len(s.CollectorIntervals))
+		for name, interval := range s.CollectorIntervals {
+			collectorIntervals = append(collectorIntervals, name+"="+interval)
+		}
+		sort.Strings(collectorIntervals)
+		collectInterval := s.CollectInterval
+		if collectInterval == "" && s.Pushes() {
+			collectInterval = DefaultPushInterval.String()
+		}
+		remoteWrite, err := jsonenv(s.RemoteWrite)
+		if err != nil {
+			return nil, err
+		}
+		pushgateway, err := jsonenv(s.Pushgateway)
+		if err != nil {
+			return nil, err
+		}
+		influxDB, err := jsonenv(s.InfluxDB)
+		if err != nil {
+			return nil, err
+		}
+		graphite, err := jsonenv(s.Graphite)
+		if err != nil {
+			return nil, err
+		}
+		statsd, err := jsonenv(s.StatsD)
+		if err != nil {
+			return nil, err
+		}
+		otlp, err := jsonenv(s.OTLP)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, &Child{
+			Name:     fmt.Sprintf("exporter %s@%s:%d listening %d", s.User, s.Host, s.Port, s.Local),
+			Pass:     pass,
+			Instance: s.Host,
+			Local:    s.Local,
+			Labels:   labels,
+			Env: []string{
+				"SSH_HOST=" + s.Host,
+				"SSH_PORT=" + strconv.Itoa(s.Port),
+				"SSH_USER=" + s.User,
+				"SSH_KEY=" + s.Key,
+				"SSH_SCRIPT=" + s.Script,
+				"PORT=" + strconv.Itoa(s.Local),
+				"TCPSTAT_PORTS=" + strings.Join(tcpstatPorts, ","),
+				"SMARTCTL=" + boolenv(s.Smartctl),
+				"SMARTCTL_SUDO=" + boolenv(s.SmartctlSudo),
+				"SMARTCTL_INTERVAL=" + s.SmartctlInterval,
+				"EXPORTERS=" + string(exporters),
+				"LABELS=" + string(labelsJSON),
+				"LABELS_MODE=" + config.LabelsMode,
+				"COLLECT_INTERVAL=" + collectInterval,
+				"MAX_STALENESS=" + s.MaxStaleness,
+				"COLLECTOR_INTERVALS=" + strings.Join(collectorIntervals, ","),
+				"REMOTE_WRITE=" + remoteWrite,
+				"PUSHGATEWAY=" + pushgateway,
+				"INFLUXDB=" + influxDB,
+				"GRAPHITE=" + graphite,
+				"STATSD=" + statsd,
+				"OTLP=" + otlp,
+			},
+		})
+	}
+
+	for _, s := range config.Forward {
+		pass, err := config.expandSsh(&s.Host, &s.User, &s.Key, s.Pass, s.PassFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s@%s: %v", s.User, s.Host, err)
+		}
+		if s.Host == "" {
+			return nil, fmt.Errorf("%s@%s: host is empty", s.User, s.Host)
+		}
+		if s.Port == 0 {
+			s.Port = 22
+		}
+		children = append(children, &Child{
+			Name: fmt.Sprintf("forward %s@%s:%d listening %d tunneling %s", s.User, s.Host, s.Port, s.Local, s.Remote),
+			Pass: pass,
+			Lazy: true,
+			Env: []string{
+				"SSH_HOST=" + s.Host,
+				"SSH_PORT=" + strconv.Itoa(s.Port),
+				"SSH_USER=" + s.User,
+				"SSH_KEY=" + s.Key,
+				"PORT=" + strconv.Itoa(s.Local),
+				"REMOTE_ADDR=" + s.Remote,
+				"LOCAL_ADDR=" + s.LocalSocket,
+				"LOCAL_SOCKET_MODE=" + s.LocalSocketMode,
+				"METRICS_PORT=" + portenv(s.Metrics),
+				"MAX_CONNECTIONS=" + strconv.Itoa(s.MaxConnections),
+				"IDLE_TIMEOUT=" + s.IdleTimeout,
+			},
+		})
+	}
+
+	for _, s := range config.Reverse {
+		pass, err := config.expandSsh(&s.Host, &s.User, &s.Key, s.Pass, s.PassFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s@%s: %v", s.User, s.Host, err)
+		}
+		if s.Host == "" {
+			return nil, fmt.Errorf("%s@%s: host is empty", s.User, s.Host)
+		}
+		if s.Port == 0 {
+			s.Port = 22
+		}
+		children = append(children, &Child{
+			Name: fmt.Sprintf("reverse %s@%s:%d listening %s tunneling %s", s.User, s.Host, s.Port, s.Remote, s.Local),
+			Pass: pass,
+			Env: []string{
+				"SSH_HOST=" + s.Host,
+				"SSH_PORT=" + strconv.Itoa(s.Port),
+				"SSH_USER=" + s.User,
+				"SSH_KEY=" + s.Key,
+				"FORWARD_TYPE=reverse",
+				"REMOTE_ADDR=" + s.Remote,
+				"LOCAL_ADDR=" + s.Local,
+				"METRICS_PORT=" + portenv(s.Metrics),
+				"MAX_CONNECTIONS=" + strconv.Itoa(s.MaxConnections),
+				"IDLE_TIMEOUT=" + s.IdleTimeout,
+			},
+		})
+	}
+
+	for _, s := range config.Socks {
+		pass, err := config.expandSsh(&s.Host, &s.User, &s.Key, s.Pass, s.PassFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s@%s: %v", s.User, s.Host, err)
+		}
+		if s.Host == "" {
+			return nil, fmt.Errorf("%s@%s: host is empty", s.User, s.Host)
+		}
+		if s.Port == 0 {
+			s.Port = 22
+		}
+		children = append(children, &Child{
+			Name: fmt.Sprintf("socks %s@%s:%d listening %d", s.User, s.Host, s.Port, s.Local),
+			Pass: pass,
+			Lazy: true,
+			Env: []string{
+				"SSH_HOST=" + s.Host,
+				"SSH_PORT=" + strconv.Itoa(s.Port),
+				"SSH_USER=" + s.User,
+				"SSH_KEY=" + s.Key,
+				"FORWARD_TYPE=socks",
+				"PORT=" + strconv.Itoa(s.Local),
+				"SOCKS_USER=" + s.Username,
+				"SOCKS_PASS_FILE=" + s.PasswordFile,
+				"METRICS_PORT=" + portenv(s.Metrics),
+				"MAX_CONNECTIONS=" + strconv.Itoa(s.MaxConnections),
+				"IDLE_TIMEOUT=" + s.IdleTimeout,
+			},
+		})
+	}
+
+	// the children get the expanded values, not the variables
+	for _, c := range children {
+		for name := range config.envSecrets {
+			c.SecretEnv = append(c.SecretEnv, name)
+		}
+	}
+
+	return children, nil
+}
+
+// expandSsh expands the ssh settings of an entry in place and returns its
+// password.
+func (config *Config) expandSsh(host, user, key *string, pass, passFile string) (string, error) {
+	for _, p := range []*string{host, user, key} {
+		v, err := config.Expand(*p)
+		if err != nil {
+			return "", err
+		}
+		*p = v
+	}
+
+	return config.Password(pass, passFile)
+}
+
+// Child is a child process serving one config entry, it is restarted with
+// exponential backoff whenever it exits until Stop is called.
+type Child struct {
+	Name string
+	Env  []string
+	Pass string
+
+	// Instance, Local and Labels describe the scrape target of an exporter
+	Instance string
+	Local    int
+	Labels   map[string]string
+
+	// StatusFile is where the child reports its TargetStatus
+	StatusFile string
+
+	// Lazy children dial ssh on their first connection, so readiness only
+	// waits for them to run
+	Lazy bool
+
+	// SecretEnv are removed from the environment of the child
+	SecretEnv []string
+
+	cmd      *exec.Cmd
+	started  time.Time
+	restarts int
+	exit     string
+	exitTime time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+var (
+	RestartBackoffMin = time.Second
+	RestartBackoffMax = time.Minute
+)
+
+// Key identifies the child, a child whose key is unchanged after a reload
+// keeps running with its ssh connection.
+func (c *Child) Key() string {
+	return c.Name + "\x00" + strings.Join(c.Env, "\x00") + "\x00" + c.Pass
+}
+
+// environ returns the environment of this process without the variables
+// named by unset.
+func environ(unset []string) []string {
+	env := make([]string, 0)
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		found := false
+		for _, s := range unset {
+			if name == s {
+				found = true
+			}
+		}
+		if !found {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func (c *Child) Start(exe string) {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.supervise(exe)
+}
+
+func (c *Child) supervise(exe string) {
+	defer close(c.done)
+
+	backoff := RestartBackoffMin
+	for {
+		cmd := exec.Command(exe)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(environ(c.SecretEnv), c.Env...)
+		if c.Pass != "" {
+			// the password is piped to the child instead of its environment
+			// which is readable in /proc/<pid>/environ
+			cmd.Env = append(cmd.Env, "SSH_PASS_FILE=/dev/stdin")
+			cmd.Stdin = strings.NewReader(c.Pass)
+		}
+		if c.StatusFile != "" {
+			// a restarted child starts with a fresh status
+			os.Remove(c.StatusFile)
+			cmd.Env = append(cmd.Env, "STATUS_FILE="+c.StatusFile)
+		}
+
+		c.mu.Lock()
+		select {
+		case <-c.stop:
+			c.mu.Unlock()
+			return
+		default:
+		}
+		err := cmd.Start()
+		if err == nil {
+			c.cmd = cmd
+			c.started = time.Now()
+		}
+		c.mu.Unlock()
+
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		c.mu.Lock()
+		if c.cmd != nil && time.Since(c.started) > RestartBackoffMax {
+			backoff = RestartBackoffMin
+		}
+		c.cmd = nil
+		c.exit = "exit status 0"
+		if err != nil {
+			c.exit = err.Error()
+		}
+		c.exitTime = time.Now()
+		c.mu.Unlock()
+
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		log.Errorf("%s exited: %s, restarting in %s\n", c.Name, c.exit, backoff)
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		c.mu.Lock()
+		c.restarts++
+		c.mu.Unlock()
+
+		if backoff *= 2; backoff > RestartBackoffMax {
+			backoff = RestartBackoffMax
+		}
+	}
+}
+
+// Stop terminates the child and waits for it to exit, it is killed if it is
+// still running after timeout.
+func (c *Child) Stop(timeout time.Duration) {
+	if c.stop == nil {
+		return
+	}
+
+	c.mu.Lock()
+	close(c.stop)
+	cmd := c.cmd
+	c.mu.Unlock()
+
+	if c.StatusFile != "" {
+		defer os.Remove(c.StatusFile)
+	}
+
+	if cmd == nil {
+		<-c.done
+		return
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-c.done:
+	case <-time.After(timeout):
+		log.Errorf("%s did not exit in %s, killing\n", c.Name, timeout)
+		cmd.Process.Kill()
+		<-c.done
+	}
+}
+
+type ChildStatus struct {
+	Name     string     `json:"name"`
+	State    string     `json:"state"`
+	Pid      int        `json:"pid,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Restarts int        `json:"restarts"`
+	Exit     string     `json:"last_exit,omitempty"`
+	ExitTime *time.Time `json:"last_exit_time,omitempty"`
+
+	Target *TargetStatus `json:"target,omitempty"`
+
+	lazy bool
+}
+
+func (c *Child) Status() ChildStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := ChildStatus{
+		Name:     c.Name,
+		State:    "restarting",
+		Restarts: c.restarts,
+		Exit:     c.exit,
+		lazy:     c.Lazy,
+	}
+	if !c.exitTime.IsZero() {
+		exitTime := c.exitTime
+		status.ExitTime = &exitTime
+	}
+
+	switch {
+	case c.cmd != nil:
+		status.State = "running"
+		status.Pid = c.cmd.Process.Pid
+		started := c.started
+		status.Started = &started
+		if c.StatusFile != "" {
+			status.Target = ReadStatus(c.StatusFile)
+		}
+	case c.stop == nil:
+		status.State = "stopped"
+	default:
+		select {
+		case <-c.stop:
+			status.State = "stopped"
+		default:
+		}
+	}
+
+	return status
+}
+
+type Master struct {
+	Exe             string
+	ConfigFile      string
+	ShutdownTimeout time.Duration
+	WatchConfig     bool
+	SDHost          string
+	SDFile          string
+	StatusDir       string
+
+	children map[string]*Child
+	seq      int
+	shutdown bool
+	mu       sync.Mutex
+
+	discovery      Discovery
+	discoveryFiles []string
+	refresh        time.Duration
+	discoveryMu    sync.Mutex
+	watcher        *fsnotify.Watcher
+}
+
+// Reload re-reads the config file, stops the children whose entries are
+// removed or changed and starts the new ones, unchanged children are kept.
+func (m *Master) Reload() error {
+	return m.reload(true)
+}
+
+func (m *Master) reload(verbose bool) error {
+	config, err := LoadConfig(m.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if err := m.discover(config); err != nil {
+		return err
+	}
+
+	children, err := config.Children()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shutdown {
+		return fmt.Errorf("%s is shutting down", m.ConfigFile)
+	}
+
+	next := make(map[string]*Child)
+	for _, c := range children {
+		if old, ok := m.children[c.Key()]; ok {
+			old.Labels = c.Labels
+			next[c.Key()] = old
+		} else {
+			next[c.Key()] = c
+		}
+	}
+
+	var stopped, started int
+	for key, c := range m.children {
+		if _, ok := next[key]; !ok {
+			log.Infof("stopping %s\n", c.Name)
+			c.Stop(m.ShutdownTimeout)
+			stopped++
+		}
+	}
+
+	for _, c := range next {
+		if c.stop != nil {
+			continue
+		}
+		log.Infof("starting %s\n", c.Name)
+		if m.StatusDir != "" {
+			m.seq++
+			c.StatusFile = filepath.Join(m.StatusDir, strconv.Itoa(m.seq)+".json")
+		}
+		c.Start(m.Exe)
+		started++
+	}
+
+	m.children = next
+	if verbose || stopped+started > 0 {
+		log.Infof("%s loaded, %d children, %d stopped, %d started\n", m.ConfigFile, len(next), stopped, started)
+	}
+
+	if m.SDFile != "" {
+		if err := WriteSDFile(m.SDFile, m.targetGroups()); err != nil {
+			log.Errorf("write %s error: %+v\n", m.SDFile, err)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops all children in parallel, each child is given timeout to
+// exit gracefully before it is killed.
+func (m *Master) Shutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shutdown = true
+
+	var wg sync.WaitGroup
+	for _, c := range m.children {
+		wg.Add(1)
+		go func(c *Child) {
+			defer wg.Done()
+			c.Stop(m.ShutdownTimeout)
+		}(c)
+	}
+	wg.Wait()
+
+	m.children = nil
+
+	if m.StatusDir != "" {
+		os.RemoveAll(m.StatusDir)
+	}
+}
+
+// ServeSignals reloads the config on SIGHUP, and stops all children then
+// exits on SIGTERM or SIGINT.
+func (m *Master) ServeSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			log.Infof("received %s, stopping %d children\n", sig, len(m.Status()))
+			m.Shutdown()
+			os.Exit(0)
+		}
+		log.Infof("received SIGHUP, reloading %s\n", m.ConfigFile)
+		if err := m.Reload(); err != nil {
+			log.Errorf("reload %s error: %+v\n", m.ConfigFile, err)
+		}
+	}
+}
+
+func (m *Master) discover(config *Config) error {
+	m.discoveryMu.Lock()
+	defer m.discoveryMu.Unlock()
+
+	if err := m.discovery.Discover(config); err != nil {
+		return err
+	}
+
+	m.discoveryFiles = m.discoveryFiles[:0]
+	m.refresh = 0
+	for _, s := range config.Discovery {
+		for _, pattern := range s.Files {
+			if pattern, err := filepath.Abs(pattern); err == nil {
+				m.discoveryFiles = append(m.discoveryFiles, pattern)
+			}
+		}
+		if s.URL != "" && (m.refresh == 0 || s.Interval() < m.refresh) {
+			m.refresh = s.Interval()
+		}
+	}
+
+	if m.watcher != nil {
+		for _, pattern := range m.discoveryFiles {
+			m.watcher.Add(filepath.Dir(pattern))
+		}
+	}
+
+	return nil
+}
+
+// Refresh reloads periodically while there are http discovery sources.
+func (m *Master) Refresh() {
+	for {
+		m.discoveryMu.Lock()
+		refresh := m.refresh
+		m.discoveryMu.Unlock()
+
+		if refresh == 0 {
+			time.Sleep(DefaultRefreshInterval)
+			continue
+		}
+
+		time.Sleep(refresh)
+		if err := m.reload(false); err != nil {
+			log.Errorf("refresh %s error: %+v\n", m.ConfigFile, err)
+		}
+	}
+}
+
+// Watch reloads when the config file if WatchConfig is set or a file_sd file
+// changes, the directories are watched so that editors replacing the file
+// are noticed as well.
+func (m *Master) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	filename, err := filepath.Abs(m.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if m.WatchConfig {
+		if err := watcher.Add(filepath.Dir(filename)); err != nil {
+			return err
+		}
+	}
+
+	m.discoveryMu.Lock()
+	m.watcher = watcher
+	for _, pattern := range m.discoveryFiles {
+		watcher.Add(filepath.Dir(pattern))
+	}
+	m.discoveryMu.Unlock()
+
+	defer func() {
+		m.discoveryMu.Lock()
+		m.watcher = nil
+		m.discoveryMu.Unlock()
+	}()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			if m.WatchConfig && filepath.Clean(event.Name) == filename || m.isDiscoveryFile(event.Name) {
+				timer = time.After(time.Second)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("watch %s error: %+v\n", m.ConfigFile, err)
+		case <-timer:
+			log.Infof("%s changed, reloading\n", m.ConfigFile)
+			if err := m.Reload(); err != nil {
+				log.Errorf("reload %s error: %+v\n", m.ConfigFile, err)
+			}
+		}
+	}
+}
+
+// NeedsWatch reports whether there is anything for Watch to watch.
+func (m *Master) NeedsWatch() bool {
+	m.discoveryMu.Lock()
+	defer m.discoveryMu.Unlock()
+
+	return m.WatchConfig || len(m.discoveryFiles) > 0
+}
+
+// PollInterval is how often Poll checks the files for changes.
+var PollInterval = 10 * time.Second
+
+// Poll reloads when the config file if WatchConfig is set or a file_sd file
+// changes, by comparing their modification times. It is the fallback of Watch
+// when the files cannot be watched.
+func (m *Master) Poll() {
+	stamp := func() string {
+		m.discoveryMu.Lock()
+		defer m.discoveryMu.Unlock()
+
+		files := make([]string, 0)
+		if m.WatchConfig {
+			files = append(files, m.ConfigFile)
+		}
+		for _, pattern := range m.discoveryFiles {
+			matches, _ := filepath.Glob(pattern)
+			files = append(files, matches...)
+		}
+		return fileStamp(files...)
+	}
+
+	last := stamp()
+	for {
+		time.Sleep(PollInterval)
+		if s := stamp(); s != last {
+			last = s
+			log.Infof("%s changed, reloading\n", m.ConfigFile)
+			if err := m.Reload(); err != nil {
+				log.Errorf("reload %s error: %+v\n", m.ConfigFile, err)
+			}
+		}
+	}
+}
+
+func (m *Master) isDiscoveryFile(name string) bool {
+	m.discoveryMu.Lock()
+	defer m.discoveryMu.Unlock()
+
+	for _, pattern := range m.discoveryFiles {
+		if ok, _ := filepath.Match(pattern, filepath.Clean(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Master) HandleReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		rw.Header().Set("Allow", "POST, PUT")
+		http.Error(rw, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := m.Reload(); err != nil {
+		http.Error(rw, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (m *Master) Status() []ChildStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make([]ChildStatus, 0, len(m.children))
+	for _, c := range m.children {
+		status = append(status, c.Status())
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+
+	return status
+}
+
+func (m *Master) HandleStatus(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(m.Status())
+}
+
+// HandleReady returns 200 once the config is loaded, the ssh connections of
+// the exporter and reverse children are established and the forward and
+// socks children are running, and until shutdown.
+func (m *Master) HandleReady(rw http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	ready := m.children != nil && !m.shutdown
+	m.mu.Unlock()
+
+	if !ready {
+		http.Error(rw, "Not ready.", http.StatusServiceUnavailable)
+		return
+	}
+
+	pending := make([]string, 0)
+	for _, status := range m.Status() {
+		state := "starting"
+		switch {
+		case status.lazy:
+			if status.State == "running" {
+				continue
+			}
+			state = status.State
+		case status.Target != nil:
+			state = status.Target.State
+		}
+		if state != "connected" {
+			pending = append(pending, fmt.Sprintf("%s is %s", status.Name, state))
+		}
+	}
+	if len(pending) > 0 {
+		http.Error(rw, "Not ready, "+strings.Join(pending, ", ")+".", http.StatusServiceUnavailable)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("Ready.\n"))
+}
+
+// HandleIndex serves the status page of all children.
+func (m *Master) HandleIndex(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(rw, req)
+		return
+	}
+	WriteStatusPage(rw, req, "Remote Node Exporter "+m.ConfigFile, []string{"/-/status", "/sd"}, m.Status())
+}
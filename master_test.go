@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasterHandleReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// child returns a running child with its target in state, or a stopped
+	// one if state is empty
+	child := func(name, state string, lazy bool) *Child {
+		c := &Child{Name: name, Lazy: lazy}
+		if state == "" {
+			return c
+		}
+		c.cmd = cmd
+		if state != "starting" {
+			c.StatusFile = filepath.Join(dir, name+"-"+state+".json")
+			if err := ioutil.WriteFile(c.StatusFile, []byte(`{"state":"`+state+`"}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c
+	}
+
+	cases := []struct {
+		name     string
+		children []*Child
+		shutdown bool
+		status   int
+		body     string
+	}{
+		{
+			name:   "not loaded",
+			status: http.StatusServiceUnavailable,
+			body:   "Not ready.\n",
+		},
+		{
+			// forward and socks children dial on demand and stay connecting
+			name: "connected",
+			children: []*Child{
+				child("exporter", "connected", false),
+				child("reverse", "connected", false),
+				child("forward", "connecting", true),
+				child("socks", "starting", true),
+			},
+			status: http.StatusOK,
+			body:   "Ready.\n",
+		},
+		{
+			name: "pending",
+			children: []*Child{
+				child("exporter", "disconnected", false),
+				child("reverse", "starting", false),
+				child("forward", "connecting", true),
+				child("socks", "", true),
+			},
+			status: http.StatusServiceUnavailable,
+			body:   "Not ready, exporter is disconnected, reverse is starting, socks is stopped.\n",
+		},
+		{
+			name:     "shutdown",
+			children: []*Child{child("exporter", "connected", false)},
+			shutdown: true,
+			status:   http.StatusServiceUnavailable,
+			body:     "Not ready.\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Master{shutdown: c.shutdown}
+			if c.children != nil {
+				m.children = make(map[string]*Child)
+				for _, child := range c.children {
+					m.children[child.Name] = child
+				}
+			}
+
+			rw := httptest.NewRecorder()
+			m.HandleReady(rw, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+
+			if rw.Code != c.status || !strings.HasPrefix(rw.Body.String(), c.body) {
+				t.Errorf("HandleReady() = %d %q, want %d %q", rw.Code, rw.Body.String(), c.status, c.body)
+			}
+		})
+	}
+}
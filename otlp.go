@@ -0,0 +1,445 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+type OTLPConfig struct {
+	// Endpoint is the url of the otlp/http receiver, /v1/metrics is
+	// appended if it has no path.
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+
+	HTTPAuth `yaml:",inline"`
+}
+
+var OTLP *OTLPConfig = func() *OTLPConfig {
+	s := os.Getenv("OTLP")
+	if s == "" {
+		return nil
+	}
+	config := &OTLPConfig{}
+	if err := json.Unmarshal([]byte(s), config); err != nil {
+		log.Fatalf("unable to parse OTLP %#v: %v", s, err)
+	}
+	return config
+}()
+
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/collector/metrics/v1/metrics_service.proto
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+//
+// message ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+// message ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+// message Resource { repeated KeyValue attributes = 1; }
+// message ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+// message InstrumentationScope { string name = 1; string version = 2; }
+// message Metric { string name = 1; string description = 2; string unit = 3; Gauge gauge = 5; Sum sum = 7; }
+// message Gauge { repeated NumberDataPoint data_points = 1; }
+// message Sum { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+// message NumberDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; double as_double = 4; }
+// message KeyValue { string key = 1; AnyValue value = 2; }
+// message AnyValue { string string_value = 1; bool bool_value = 2; int64 int_value = 3; double double_value = 4; }
+
+const otlpTemporalityCumulative = 2
+
+func appendFixed64Field(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field<<3|1))
+	b = append(b, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(b[len(b)-8:], v)
+	return b
+}
+
+func appendKeyValue(b []byte, field int, key, value string) []byte {
+	var v []byte
+	v = appendBytesField(v, 1, []byte(value))
+	var kv []byte
+	kv = appendBytesField(kv, 1, []byte(key))
+	kv = appendBytesField(kv, 2, v)
+	return appendBytesField(b, field, kv)
+}
+
+// EncodeOTLP encodes samples as an otlp ExportMetricsServiceRequest, a metric
+// has a data point for every series of the same name. Counters and the
+// buckets, sums and counts of histograms and summaries are monotonic
+// cumulative sums, the other samples are gauges. The node_* sums start at
+// boot if it is not zero, the start of other sums is unknown and left unset.
+// Data point attributes which are resource attributes are dropped.
+func EncodeOTLP(samples []Sample, resource []Label, boot, ts time.Time) []byte {
+	var r []byte
+	for _, l := range resource {
+		r = appendKeyValue(r, 1, l.Name, l.Value)
+	}
+
+	promoted := make(map[Label]bool, len(resource))
+	for _, l := range resource {
+		promoted[l] = true
+	}
+
+	names := make([]string, 0)
+	series := make(map[string][]Sample)
+	for _, s := range samples {
+		if _, ok := series[s.Name]; !ok {
+			names = append(names, s.Name)
+		}
+		series[s.Name] = append(series[s.Name], s)
+	}
+
+	var scope []byte
+	var is []byte
+	is = appendBytesField(is, 1, []byte("remote_node_exporter"))
+	is = appendBytesField(is, 2, []byte(version.Version))
+	scope = appendBytesField(scope, 1, is)
+
+	for _, name := range names {
+		first := series[name][0]
+
+		var points []byte
+		for _, s := range series[name] {
+			var p []byte
+			for _, l := range s.Labels {
+				if !promoted[l] && !promoted[Label{otlpAttribute(l.Name), l.Value}] {
+					p = appendKeyValue(p, 7, l.Name, l.Value)
+				}
+			}
+			if cumulative(s) && !boot.IsZero() && strings.HasPrefix(s.Name, "node_") {
+				p = appendFixed64Field(p, 2, uint64(boot.UnixNano()))
+			}
+			p = appendFixed64Field(p, 3, uint64(ts.UnixNano()))
+			p = appendFixed64Field(p, 4, math.Float64bits(s.Value))
+			points = appendBytesField(points, 1, p)
+		}
+
+		var m []byte
+		m = appendBytesField(m, 1, []byte(name))
+		if first.Help != "" {
+			m = appendBytesField(m, 2, []byte(first.Help))
+		}
+		if cumulative(first) {
+			points = appendVarint(points, 2<<3|0)
+			points = appendVarint(points, otlpTemporalityCumulative)
+			points = appendVarint(points, 3<<3|0)
+			points = appendVarint(points, 1)
+			m = appendBytesField(m, 7, points)
+		} else {
+			m = appendBytesField(m, 5, points)
+		}
+		scope = appendBytesField(scope, 2, m)
+	}
+
+	var rm []byte
+	rm = appendBytesField(rm, 1, r)
+	rm = appendBytesField(rm, 2, scope)
+
+	return appendBytesField(nil, 1, rm)
+}
+
+// otlpAttribute returns the resource attribute of a push label.
+func otlpAttribute(name string) string {
+	switch name {
+	case "instance":
+		return "host.name"
+	case "job":
+		return "service.name"
+	}
+	return name
+}
+
+// OTLPResource returns the resource attributes of the target, which are
+// host.name, os.type from the uname sysname, service.name and the target
+// labels.
+func OTLPResource(uname map[string]string) []Label {
+	resource := []Label{{"host.name", SshHost}}
+	if sysname := uname["sysname"]; sysname != "" {
+		resource = append(resource, Label{"os.type", strings.ToLower(sysname)})
+	}
+	resource = append(resource, Label{"service.name", "remote_node_exporter"})
+	names := make([]string, 0, len(Labels))
+	for name := range Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource = append(resource, Label{name, Labels[name]})
+	}
+	return resource
+}
+
+// OTLPSink pushes samples to an otlp/http receiver in protobuf encoding.
+type OTLPSink struct {
+	Config *OTLPConfig
+
+	client *Client
+	url    string
+}
+
+func NewOTLPSink(config *OTLPConfig, client *Client) *OTLPSink {
+	u := config.Endpoint
+	if v, err := url.Parse(u); err == nil && strings.Trim(v.Path, "/") == "" {
+		v.Path = "/v1/metrics"
+		u = v.String()
+	}
+
+	return &OTLPSink{
+		Config: config,
+		client: client,
+		url:    u,
+	}
+}
+
+func (sink *OTLPSink) Name() string {
+	return "otlp " + sink.url
+}
+
+func (sink *OTLPSink) Write(samples []Sample, ts time.Time) error {
+	return pushHTTP(http.MethodPost, sink.url, "application/x-protobuf", sink.Config.HTTPAuth, EncodeOTLP(samples, OTLPResource(sink.client.Uname()), BootTime(samples), ts))
+}
+
+// BootTime returns the node_boot_time_seconds of samples, or the zero time if
+// there is none.
+func BootTime(samples []Sample) time.Time {
+	for _, s := range samples {
+		if s.Name == "node_boot_time_seconds" && s.Value > 0 {
+			return time.Unix(int64(s.Value), 0)
+		}
+	}
+	return time.Time{}
+}
+
+// readProto calls fn with every field of the protobuf message b, v is the
+// value of varint and fixed fields and data the value of bytes fields.
+func readProto(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errors.New("truncated bytes")
+			}
+			data, b = b[n:n+int(size)], b[n+int(size):]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeKeyValue(b []byte) (Label, error) {
+	var l Label
+	err := readProto(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			l.Name = string(data)
+		case 2:
+			return readProto(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					l.Value = string(data)
+				case 2:
+					l.Value = strconv.FormatBool(v != 0)
+				case 3:
+					l.Value = strconv.FormatInt(int64(v), 10)
+				case 4:
+					l.Value = strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return l, err
+}
+
+// DecodeOTLP decodes the gauges and sums of an otlp ExportMetricsServiceRequest
+// into one line per data point in the text exposition format, prefixed by a
+// line of resource attributes. Data points without a time are rejected.
+func DecodeOTLP(b []byte) ([]string, error) {
+	lines := make([]string, 0)
+
+	decodeMetric := func(b []byte) error {
+		var name, kind string
+		var points [][]byte
+		monotonic, temporality := false, uint64(0)
+		err := readProto(b, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				name = string(data)
+			case 5, 7:
+				kind = map[int]string{5: "gauge", 7: "sum"}[field]
+				return readProto(data, func(field int, v uint64, data []byte) error {
+					switch field {
+					case 1:
+						points = append(points, data)
+					case 2:
+						temporality = v
+					case 3:
+						monotonic = v != 0
+					}
+					return nil
+				})
+			case 9, 10, 11:
+				return fmt.Errorf("metric %s: unsupported data %d", name, field)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return errors.New("metric without name")
+		}
+		if kind == "sum" {
+			kind = fmt.Sprintf("sum monotonic=%t temporality=%d", monotonic, temporality)
+		}
+
+		for _, p := range points {
+			var attributes []string
+			var start, ts, value uint64
+			err := readProto(p, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 2:
+					start = v
+				case 7:
+					l, err := decodeKeyValue(data)
+					if err != nil {
+						return err
+					}
+					attributes = append(attributes, l.Name+"="+strconv.Quote(l.Value))
+				case 3:
+					ts = v
+				case 4, 6:
+					value = v
+					if field == 6 {
+						value = math.Float64bits(float64(int64(v)))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if ts == 0 {
+				return fmt.Errorf("metric %s: data point without time_unix_nano", name)
+			}
+			line := fmt.Sprintf("%s{%s} %s %d # %s", name, strings.Join(attributes, ","), strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64), ts/uint64(time.Millisecond), kind)
+			if start != 0 {
+				line += fmt.Sprintf(" start=%d", start/uint64(time.Millisecond))
+			}
+			lines = append(lines, line)
+		}
+		return nil
+	}
+
+	err := readProto(b, func(field int, v uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		return readProto(data, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				var attributes []string
+				err := readProto(data, func(field int, v uint64, data []byte) error {
+					if field == 1 {
+						l, err := decodeKeyValue(data)
+						attributes = append(attributes, l.Name+"="+strconv.Quote(l.Value))
+						return err
+					}
+					return nil
+				})
+				lines = append(lines, "# resource "+strings.Join(attributes, ","))
+				return err
+			case 2:
+				return readProto(data, func(field int, v uint64, data []byte) error {
+					if field == 2 {
+						return decodeMetric(data)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+
+	return lines, err
+}
+
+// HandleOTLP is a local otlp/http receiver which verifies and prints the
+// payloads, for testing the otlp output.
+func HandleOTLP(rw http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ct := req.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		http.Error(rw, fmt.Sprintf("unsupported content type %#v", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	lines, err := DecodeOTLP(data)
+	if err != nil {
+		log.Errorf("%s %s error: %+v\n", req.Method, req.URL, err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("# %s %d bytes from %s\n%s\n", req.URL.Path, len(data), req.RemoteAddr, strings.Join(lines, "\n"))
+
+	// an empty ExportMetricsServiceResponse
+	rw.Header().Set("Content-Type", "application/x-protobuf")
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOTLPResource(t *testing.T) {
+	defer func(host string, labels map[string]string) {
+		SshHost, Labels = host, labels
+	}(SshHost, Labels)
+	SshHost, Labels = "web1", map[string]string{"site": "dc1", "role": "web"}
+
+	cases := []struct {
+		uname map[string]string
+		want  []Label
+	}{
+		{
+			uname: map[string]string{"sysname": "Linux", "release": "5.10.0"},
+			want: []Label{
+				{"host.name", "web1"},
+				{"os.type", "linux"},
+				{"service.name", "remote_node_exporter"},
+				{"role", "web"},
+				{"site", "dc1"},
+			},
+		},
+		{
+			uname: map[string]string{"sysname": "FreeBSD"},
+			want: []Label{
+				{"host.name", "web1"},
+				{"os.type", "freebsd"},
+				{"service.name", "remote_node_exporter"},
+				{"role", "web"},
+				{"site", "dc1"},
+			},
+		},
+		{
+			// not connected yet
+			uname: nil,
+			want: []Label{
+				{"host.name", "web1"},
+				{"service.name", "remote_node_exporter"},
+				{"role", "web"},
+				{"site", "dc1"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		if got := OTLPResource(c.uname); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("OTLPResource(%v) = %v, want %v", c.uname, got, c.want)
+		}
+	}
+}
+
+func TestEncodeOTLP(t *testing.T) {
+	samples := []Sample{
+		{Name: "node_boot_time_seconds", Type: "gauge", Labels: []Label{{"instance", "web1:9100"}}, Value: 1600000000},
+		{Name: "node_load1", Type: "gauge", Help: "1m load average.", Labels: []Label{{"instance", "web1"}, {"job", "node"}}, Value: 0.25},
+		{Name: "node_cpu_seconds_total", Type: "counter", Labels: []Label{{"cpu", "0"}, {"instance", "web1"}, {"mode", "idle"}}, Value: 1234.5},
+		{Name: "node_cpu_seconds_total", Type: "counter", Labels: []Label{{"cpu", "0"}, {"instance", "web1"}, {"mode", "user"}}, Value: 56},
+		{Name: "rpc_duration_seconds", Type: "summary", Labels: []Label{{"instance", "web1:9100"}, {"quantile", "0.5"}, {"site", "dc1"}}, Value: 0.01},
+		{Name: "rpc_duration_seconds_sum", Type: "summary", Value: 17},
+		{Name: "rpc_duration_seconds_count", Type: "summary", Value: 1000},
+		{Name: "http_request_duration_seconds_bucket", Type: "histogram", Labels: []Label{{"le", "+Inf"}}, Value: 3},
+	}
+	resource := []Label{
+		{"host.name", "web1"},
+		{"os.type", "linux"},
+		{"service.name", "remote_node_exporter"},
+		{"instance", "web1:9100"},
+		{"site", "dc1"},
+	}
+	ts := time.Unix(1600000060, 500e6)
+
+	got, err := DecodeOTLP(EncodeOTLP(samples, resource, BootTime(samples), ts))
+	if err != nil {
+		t.Fatalf("DecodeOTLP() error: %+v", err)
+	}
+
+	// instance is dropped as it is the host.name or instance resource
+	// attribute, and only the node_* sums start at boot
+	want := []string{
+		`# resource host.name="web1",os.type="linux",service.name="remote_node_exporter",instance="web1:9100",site="dc1"`,
+		`node_boot_time_seconds{} 1.6e+09 1600000060500 # gauge`,
+		`node_load1{job="node"} 0.25 1600000060500 # gauge`,
+		`node_cpu_seconds_total{cpu="0",mode="idle"} 1234.5 1600000060500 # sum monotonic=true temporality=2 start=1600000000000`,
+		`node_cpu_seconds_total{cpu="0",mode="user"} 56 1600000060500 # sum monotonic=true temporality=2 start=1600000000000`,
+		`rpc_duration_seconds{quantile="0.5"} 0.01 1600000060500 # gauge`,
+		`rpc_duration_seconds_sum{} 17 1600000060500 # sum monotonic=true temporality=2`,
+		`rpc_duration_seconds_count{} 1000 1600000060500 # sum monotonic=true temporality=2`,
+		`http_request_duration_seconds_bucket{le="+Inf"} 3 1600000060500 # sum monotonic=true temporality=2`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeOTLP(EncodeOTLP()) =\n%q\nwant\n%q", got, want)
+	}
+
+	// without a boot time the start of sums is left unset
+	got, err = DecodeOTLP(EncodeOTLP(samples[2:3], resource, time.Time{}, ts))
+	if err != nil {
+		t.Fatalf("DecodeOTLP() error: %+v", err)
+	}
+	want = []string{
+		want[0],
+		`node_cpu_seconds_total{cpu="0",mode="idle"} 1234.5 1600000060500 # sum monotonic=true temporality=2`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeOTLP(EncodeOTLP()) =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDecodeOTLPErrors(t *testing.T) {
+	point := appendFixed64Field(nil, 4, 1)
+
+	var gauge []byte
+	gauge = appendBytesField(gauge, 1, point)
+
+	var metric []byte
+	metric = appendBytesField(metric, 1, []byte("up"))
+	metric = appendBytesField(metric, 5, gauge)
+
+	var scope []byte
+	scope = appendBytesField(scope, 2, metric)
+
+	var rm []byte
+	rm = appendBytesField(rm, 2, scope)
+
+	if _, err := DecodeOTLP(appendBytesField(nil, 1, rm)); err == nil {
+		t.Errorf("DecodeOTLP() accepted a data point without time_unix_nano")
+	}
+
+	if _, err := DecodeOTLP([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Errorf("DecodeOTLP() accepted a truncated message")
+	}
+}
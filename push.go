@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+type PushgatewayConfig struct {
+	URL string `yaml:"url" json:"url"`
+	Job string `yaml:"job" json:"job,omitempty"`
+
+	HTTPAuth `yaml:",inline"`
+}
+
+var Pushgateway *PushgatewayConfig = func() *PushgatewayConfig {
+	s := os.Getenv("PUSHGATEWAY")
+	if s == "" {
+		return nil
+	}
+	config := &PushgatewayConfig{}
+	if err := json.Unmarshal([]byte(s), config); err != nil {
+		log.Fatalf("unable to parse PUSHGATEWAY %#v: %v", s, err)
+	}
+	return config
+}()
+
+// PushgatewaySink replaces the group of the target, which is keyed by job and
+// instance, with every collection.
+type PushgatewaySink struct {
+	Config *PushgatewayConfig
+}
+
+func (sink *PushgatewaySink) Name() string {
+	return "pushgateway " + sink.Config.URL
+}
+
+// groupingPath encodes a grouping key label, values which are empty or
+// contain a slash are base64 encoded.
+// https://github.com/prometheus/pushgateway#url
+func groupingPath(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		return "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return "/" + name + "/" + url.PathEscape(value)
+}
+
+func (sink *PushgatewaySink) Write(samples []Sample, ts time.Time) error {
+	labels := PushLabels()
+
+	job := sink.Config.Job
+	if job == "" {
+		job = labels["job"]
+	}
+
+	// the instance label of the target wins, like for the pushed samples
+	instance := labels["instance"]
+	if instance == "" {
+		instance = SshHost
+	}
+
+	u := strings.TrimRight(sink.Config.URL, "/") + "/metrics" + groupingPath("job", job) + groupingPath("instance", instance)
+
+	// job and instance are set by the grouping key
+	body := FormatText(samples, "job", "instance")
+
+	return pushHTTP(http.MethodPut, u, "text/plain; version=0.0.4", sink.Config.HTTPAuth, []byte(body))
+}
+
+type InfluxDBConfig struct {
+	// URL is the http write endpoint including its query, e.g.
+	// http://influxdb:8086/write?db=node or http://influxdb:8086/api/v2/write?org=o&bucket=b,
+	// or udp://host:8089
+	URL string `yaml:"url" json:"url"`
+
+	// Measurement is the measurement of all samples with the metric name as
+	// field, if empty the metric name is the measurement with a value field.
+	Measurement string `yaml:"measurement" json:"measurement,omitempty"`
+
+	TokenFile string `yaml:"token_file" json:"token_file,omitempty"`
+
+	HTTPAuth `yaml:",inline"`
+}
+
+var InfluxDB *InfluxDBConfig = func() *InfluxDBConfig {
+	s := os.Getenv("INFLUXDB")
+	if s == "" {
+		return nil
+	}
+	config := &InfluxDBConfig{}
+	if err := json.Unmarshal([]byte(s), config); err != nil {
+		log.Fatalf("unable to parse INFLUXDB %#v: %v", s, err)
+	}
+	return config
+}()
+
+// MaxUDPPayload is the max size of a udp datagram sent by push outputs.
+var MaxUDPPayload = 1400
+
+// InfluxDBSink writes samples in influxdb line protocol over http or udp,
+// labels become tags.
+type InfluxDBSink struct {
+	Config *InfluxDBConfig
+
+	udp *pushConn
+}
+
+func NewInfluxDBSink(config *InfluxDBConfig) *InfluxDBSink {
+	sink := &InfluxDBSink{Config: config}
+
+	if strings.HasPrefix(config.URL, "udp://") {
+		sink.udp = &pushConn{Network: "udp", Address: strings.TrimPrefix(config.URL, "udp://")}
+	}
+
+	return sink
+}
+
+func (sink *InfluxDBSink) Name() string {
+	return "influxdb " + sink.Config.URL
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// https://docs.influxdata.com/influxdb/v1/write_protocols/line_protocol_reference/
+func (sink *InfluxDBSink) Lines(samples []Sample, ts time.Time) []string {
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		// NaN and Inf are not valid field values
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+
+		measurement, field := s.Name, "value"
+		if sink.Config.Measurement != "" {
+			measurement, field = sink.Config.Measurement, s.Name
+		}
+
+		var b strings.Builder
+		b.WriteString(influxMeasurementEscaper.Replace(measurement))
+		for _, l := range s.Labels {
+			if l.Value == "" {
+				continue
+			}
+			b.WriteString("," + influxTagEscaper.Replace(l.Name) + "=" + influxTagEscaper.Replace(l.Value))
+		}
+		b.WriteString(" " + influxTagEscaper.Replace(field) + "=" + strconv.FormatFloat(s.Value, 'g', -1, 64))
+		b.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10))
+
+		lines = append(lines, b.String())
+	}
+
+	// measurements with the same tags next to each other compress better
+	sort.Strings(lines)
+
+	return lines
+}
+
+func (sink *InfluxDBSink) Write(samples []Sample, ts time.Time) error {
+	lines := sink.Lines(samples, ts)
+
+	if sink.udp != nil {
+		return sink.udp.write(batchLines(lines, MaxUDPPayload))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sink.Config.URL, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if err := sink.Config.Apply(req); err != nil {
+		return err
+	}
+
+	// influxdb 2 uses Token instead of Bearer
+	if sink.Config.TokenFile != "" {
+		token, err := ioutil.ReadFile(sink.Config.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Token "+strings.TrimSpace(string(token)))
+	}
+
+	return doHTTP(req)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPushgatewaySink(t *testing.T) {
+	defer func(host string, labels map[string]string, mode string) {
+		SshHost, Labels, LabelsMode = host, labels, mode
+	}(SshHost, Labels, LabelsMode)
+	SshHost, LabelsMode = "10.0.0.1", LabelsModeInject
+
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		path, body = req.URL.EscapedPath(), string(data)
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name   string
+		job    string
+		labels map[string]string
+		path   string
+		body   string
+	}{
+		{
+			name: "ssh host",
+			path: "/metrics/job/remote_node_exporter/instance/10.0.0.1",
+			body: "node_load1 0.5\n",
+		},
+		{
+			name:   "instance label",
+			labels: map[string]string{"instance": "web1", "site": "dc1"},
+			path:   "/metrics/job/remote_node_exporter/instance/web1",
+			body:   "node_load1{site=\"dc1\"} 0.5\n",
+		},
+		{
+			name:   "job and a slash",
+			job:    "node",
+			labels: map[string]string{"instance": "dc1/web1"},
+			path:   "/metrics/job/node/instance@base64/ZGMxL3dlYjE",
+			body:   "node_load1 0.5\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			Labels = c.labels
+
+			sink := &PushgatewaySink{Config: &PushgatewayConfig{URL: server.URL + "/", Job: c.job}}
+			samples, err := ParseText(InjectLabels("node_load1 0.5\n", FormatLabels(PushLabels())))
+			if err != nil {
+				t.Fatalf("ParseText() error: %+v", err)
+			}
+			if err := sink.Write(samples, time.Now()); err != nil {
+				t.Fatalf("Write() error: %+v", err)
+			}
+
+			if path != c.path {
+				t.Errorf("pushed to %s, want %s", path, c.path)
+			}
+			// job and instance are only in the grouping key
+			if body != c.body {
+				t.Errorf("pushed %q, want %q", body, c.body)
+			}
+		})
+	}
+}
+
+func TestInfluxDBLines(t *testing.T) {
+	samples := []Sample{
+		{Name: "node_filesystem_avail_bytes", Labels: []Label{{"device", "/dev/sda1"}, {"fstype", ""}, {"mountpoint", "/var/lib/my data,x=1"}}, Value: 1e10},
+		{Name: "node load1", Labels: []Label{{"instance", "web1"}}, Value: 0.25},
+		{Name: "node_hwmon_temp_celsius", Value: math.Inf(1)},
+	}
+	ts := time.Unix(1600000000, 123)
+
+	cases := []struct {
+		measurement string
+		want        []string
+	}{
+		{
+			want: []string{
+				`node\ load1,instance=web1 value=0.25 1600000000000000123`,
+				`node_filesystem_avail_bytes,device=/dev/sda1,mountpoint=/var/lib/my\ data\,x\=1 value=1e+10 1600000000000000123`,
+			},
+		},
+		{
+			measurement: "node,x",
+			want: []string{
+				`node\,x,device=/dev/sda1,mountpoint=/var/lib/my\ data\,x\=1 node_filesystem_avail_bytes=1e+10 1600000000000000123`,
+				`node\,x,instance=web1 node\ load1=0.25 1600000000000000123`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		sink := &InfluxDBSink{Config: &InfluxDBConfig{Measurement: c.measurement}}
+		if got := sink.Lines(samples, ts); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Lines() with measurement %#v =\n%q\nwant\n%q", c.measurement, got, c.want)
+		}
+	}
+}
@@ -11,47 +11,118 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/alecthomas/kingpin.v2"
-	"gopkg.in/yaml.v2"
 
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
 )
 
 var (
-	configFile = kingpin.Flag("config.file", "Remote node exporter configuration file.").Default("remote_node_exporter.yml").String()
+	configFile          = kingpin.Flag("config.file", "Remote node exporter configuration file.").Default("remote_node_exporter.yml").String()
+	configWatch         = kingpin.Flag("config.watch", "Reload the configuration file when it changes.").Bool()
+	masterListenAddress = kingpin.Flag("master.listen-address", "Address of the master process to serve the status page, /-/healthy, /-/ready, /-/reload, /-/status and /sd, disabled if empty.").Default("").String()
+	sdHost              = kingpin.Flag("sd.host", "Host of the scrape addresses in /sd and --sd.file, defaults to the hostname.").Default("").String()
+	sdFile              = kingpin.Flag("sd.file", "Write the exporter targets to this prometheus file_sd file, disabled if empty.").Default("").String()
+	webConfigFile       = kingpin.Flag("web.config.file", "Path to a web config file with TLS and authentication of the exporter, forward metrics and master endpoints.").Default("").String()
+	webListenHost       = kingpin.Flag("web.listen-host", "Host of the exporter, forward metrics, forward and socks listeners, all interfaces if empty except for socks which is 127.0.0.1.").Default("").String()
+	shutdownTimeout     = kingpin.Flag("shutdown.timeout", "Time to wait for a child process to exit before it is killed.").Default("10s").Duration()
+
+	serveCommand       = kingpin.Command("serve", "Run the exporters and forwards of the configuration file.").Default()
+	checkConfigCommand = kingpin.Command("check-config", "Check the configuration files and exit non-zero on errors.")
+	checkConfigFiles   = checkConfigCommand.Arg("config-files", "Configuration files to check, defaults to --config.file.").Strings()
+
+	encryptSecretsCommand = kingpin.Command("encrypt-secrets", "Encrypt a yaml map of secrets from stdin to stdout, the key file is generated if it does not exist.")
+	encryptSecretsKeyFile = encryptSecretsCommand.Flag("key-file", "Secrets key file.").Required().String()
+
+	otlpReceiverCommand       = kingpin.Command("otlp-receiver", "Run a local otlp/http receiver which verifies and prints the pushed metrics, for testing the otlp output.")
+	otlpReceiverListenAddress = otlpReceiverCommand.Flag("listen-address", "Address to listen on.").Default("127.0.0.1:4318").String()
 )
 
 var (
-	Port       = os.Getenv("PORT")
-	SshHost    = os.Getenv("SSH_HOST")
-	SshPort    = os.Getenv("SSH_PORT")
-	SshUser    = os.Getenv("SSH_USER")
-	SshPass    = os.Getenv("SSH_PASS")
-	SshKey     = os.Getenv("SSH_KEY")
-	SshScript  = os.Getenv("SSH_SCRIPT")
-	RemoteAddr = os.Getenv("REMOTE_ADDR")
+	Port        = os.Getenv("PORT")
+	SshHost     = os.Getenv("SSH_HOST")
+	SshPort     = os.Getenv("SSH_PORT")
+	SshUser     = os.Getenv("SSH_USER")
+	SshPass     = os.Getenv("SSH_PASS")
+	SshPassFile = os.Getenv("SSH_PASS_FILE")
+	SshKey      = os.Getenv("SSH_KEY")
+	SshScript   = os.Getenv("SSH_SCRIPT")
+	RemoteAddr  = os.Getenv("REMOTE_ADDR")
+	LocalAddr   = os.Getenv("LOCAL_ADDR")
+
+	ForwardType = os.Getenv("FORWARD_TYPE")
+
+	SocksUser     = os.Getenv("SOCKS_USER")
+	SocksPassFile = os.Getenv("SOCKS_PASS_FILE")
 )
 
+var (
+	MetricsPort = os.Getenv("METRICS_PORT")
+)
+
+var MaxConnections int64 = func() int64 {
+	n, _ := strconv.ParseInt(os.Getenv("MAX_CONNECTIONS"), 10, 64)
+	return n
+}()
+
+var IdleTimeout time.Duration = func() time.Duration {
+	d, _ := time.ParseDuration(os.Getenv("IDLE_TIMEOUT"))
+	return d
+}()
+
+var LocalSocketMode os.FileMode = func() os.FileMode {
+	n, err := strconv.ParseUint(os.Getenv("LOCAL_SOCKET_MODE"), 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(n)
+}()
+
+var TcpstatPorts []int = func() []int {
+	ports := []int{}
+	for _, s := range strings.Split(os.Getenv("TCPSTAT_PORTS"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			ports = append(ports, n)
+		}
+	}
+	return ports
+}()
+
+var (
+	Smartctl     = os.Getenv("SMARTCTL") == "1"
+	SmartctlSudo = os.Getenv("SMARTCTL_SUDO") == "1"
+)
+
+var SmartctlInterval time.Duration = func() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("SMARTCTL_INTERVAL"))
+	if err != nil || d <= 0 {
+		d = time.Hour
+	}
+	return d
+}()
+
 var TextfilePath string = func() string {
 	s := os.Getenv("TEXTFILE_PATH")
 	if s == "" {
@@ -67,17 +138,31 @@ var PreReadFileList []string = []string{
 	"/proc/loadavg",
 	"/proc/meminfo",
 	"/proc/mounts",
+	"/proc/self/mountstats",
 	"/proc/net/arp",
 	"/proc/net/dev",
 	"/proc/net/netstat",
+	"/proc/net/rpc/nfs",
+	"/proc/net/rpc/nfsd",
 	"/proc/net/snmp",
 	"/proc/net/sockstat",
+	"/proc/net/tcp",
+	"/proc/net/tcp6",
+	"/proc/spl/kstat/zfs/*/io",
+	"/proc/spl/kstat/zfs/*/state",
+	"/proc/spl/kstat/zfs/arcstats",
 	"/proc/stat",
 	"/proc/sys/fs/file-nr",
 	"/proc/sys/kernel/random/entropy_avail",
 	"/proc/sys/net/netfilter/nf_conntrack_count",
 	"/proc/sys/net/netfilter/nf_conntrack_max",
 	"/proc/vmstat",
+	"/sys/fs/btrfs/*/allocation/*/bytes_reserved",
+	"/sys/fs/btrfs/*/allocation/*/bytes_used",
+	"/sys/fs/btrfs/*/allocation/*/total_bytes",
+	"/sys/fs/btrfs/*/allocation/global_rsv_size",
+	"/sys/fs/btrfs/*/devices/*/size",
+	"/sys/fs/btrfs/*/label",
 	"/tmp/proc/mdstat",
 	TextfilePath + "*.prom",
 }
@@ -93,33 +178,61 @@ type Client struct {
 	hasTimeout bool
 	script     string
 	mu         sync.Mutex
-}
 
-func (c *Client) connect() error {
-	c.client = nil
+	smartctl     string
+	smartctlErr  error
+	smartctlTime time.Time
+	smartctlMu   sync.Mutex
+
+	uname     map[string]string
+	osRelease map[string]string
+	dmi       map[string]string
+	machineID string
+
+	rtt int64
 
+	http        *http.Client
+	httpOnce    sync.Once
+	upstreams   map[string]UpstreamResult
+	upstreamsMu sync.Mutex
+
+	collected   map[string]CollectedOutput
+	collectedMu sync.Mutex
+
+	status   clientStatus
+	statusMu sync.Mutex
+}
+
+// connect returns the current ssh connection, dialing a new one if there is none.
+func (c *Client) connect() (*ssh.Client, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.client != nil {
-		return nil
+		return c.client, nil
 	}
 
-	var err error
-	c.client, err = ssh.Dial("tcp", c.Addr, c.Config)
+	client, err := ssh.Dial("tcp", c.Addr, c.Config)
 
 	if err != nil {
 		log.Infof("ssh.Dial(\"tcp\", %#v, ...) error: %+v\n", c.Addr, err)
-		return err
+		c.setConnected(err)
+		return nil, err
 	} else {
 		log.Infof("ssh.Dial(\"tcp\", %#v, ...) ok\n", c.Addr)
 	}
 
+	c.client = client
+	go c.keepalive(client)
+	go c.wait(client)
+	defer c.setConnected(nil)
+
 	session, err := c.client.NewSession()
 	if err != nil {
-		log.Infof("%v.NewSession() error: %+v, reconnecting...\n", c.client, err)
-		return err
+		log.Infof("%v.NewSession() error: %+v\n", c.client, err)
+		return c.client, nil
 	}
+	defer session.Close()
 
 	var b bytes.Buffer
 	session.Stdout = &b
@@ -138,13 +251,197 @@ func (c *Client) connect() error {
 		}
 
 	}
-	if parts[1] == "0" {
+	if len(parts) > 1 && parts[1] == "0" {
 		c.hasTimeout = true
 	}
 	log.Infof("%#v timezone is %+v, has timeout command is %+v\n", c.Addr, c.timeOffset, c.hasTimeout)
 
-	return err
+	c.identify()
+
+	return c.client, nil
+}
+
+// reconnect closes the broken connection and dials a new one, it is a no-op
+// if the connection has already been replaced by another goroutine.
+func (c *Client) reconnect(old *ssh.Client) (*ssh.Client, error) {
+	c.mu.Lock()
+	if c.client == old {
+		c.client = nil
+	}
+	c.mu.Unlock()
+
+	old.Close()
+
+	return c.connect()
+}
+
+// wait forgets the connection as soon as it is closed, so the next caller
+// dials a new one instead of reusing it until keepalive notices.
+func (c *Client) wait(client *ssh.Client) {
+	err := client.Wait()
+	if err == nil {
+		err = fmt.Errorf("ssh connection closed")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == client {
+		log.Infof("%#v connection lost: %+v\n", c.Addr, err)
+		c.client = nil
+		c.setConnected(err)
+	}
+}
+
+const KeepaliveInterval = 30 * time.Second
+
+func (c *Client) keepalive(client *ssh.Client) {
+	for {
+		time.Sleep(KeepaliveInterval)
+
+		errc := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+
+		var err error
+		select {
+		case err = <-errc:
+			atomic.StoreInt64(&c.rtt, int64(time.Since(start)))
+		case <-time.After(KeepaliveInterval):
+			err = fmt.Errorf("keepalive timed out")
+		}
+
+		if err != nil {
+			log.Infof("%#v keepalive error: %+v, closing\n", c.Addr, err)
+			c.mu.Lock()
+			if c.client == client {
+				c.client = nil
+				c.setConnected(err)
+			}
+			c.mu.Unlock()
+			client.Close()
+			return
+		}
+	}
+}
+
+// RTT returns the round trip time of the last keepalive.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Dial opens a connection to addr from the remote host, the ssh connection
+// is shared by all callers and re-established once if it is broken.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	client, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
 
+	conn, err := client.Dial(network, addr)
+	if _, ok := err.(*ssh.OpenChannelError); err == nil || ok {
+		return conn, err
+	}
+
+	log.Infof("%T.Dial(%#v, %#v) error: %+v, reconnecting...\n", client, network, addr, err)
+	if client, err = c.reconnect(client); err != nil {
+		return nil, err
+	}
+
+	return client.Dial(network, addr)
+}
+
+var IdentityFileList []string = []string{
+	"/etc/machine-id",
+	"/etc/os-release",
+	"/proc/sys/kernel/domainname",
+	"/sys/class/dmi/id/bios_date",
+	"/sys/class/dmi/id/bios_release",
+	"/sys/class/dmi/id/bios_vendor",
+	"/sys/class/dmi/id/bios_version",
+	"/sys/class/dmi/id/board_asset_tag",
+	"/sys/class/dmi/id/board_name",
+	"/sys/class/dmi/id/board_serial",
+	"/sys/class/dmi/id/board_vendor",
+	"/sys/class/dmi/id/board_version",
+	"/sys/class/dmi/id/chassis_asset_tag",
+	"/sys/class/dmi/id/chassis_serial",
+	"/sys/class/dmi/id/chassis_vendor",
+	"/sys/class/dmi/id/chassis_version",
+	"/sys/class/dmi/id/product_family",
+	"/sys/class/dmi/id/product_name",
+	"/sys/class/dmi/id/product_serial",
+	"/sys/class/dmi/id/product_sku",
+	"/sys/class/dmi/id/product_uuid",
+	"/sys/class/dmi/id/product_version",
+	"/sys/class/dmi/id/sys_vendor",
+	"/usr/lib/os-release",
+}
+
+// identify reads uname, os-release, dmi and machine-id of the remote host,
+// it must be called with c.mu held.
+func (c *Client) identify() {
+	session, err := c.client.NewSession()
+	if err != nil {
+		log.Infof("%v.NewSession() error: %+v\n", c.client, err)
+		return
+	}
+	defer session.Close()
+
+	var b bytes.Buffer
+	session.Stdout = &b
+
+	session.Run("uname -s -n -r -m; uname -v; /bin/fgrep \"\" " + strings.Join(IdentityFileList, " ") + " 2>/dev/null")
+
+	lines := strings.SplitN(b.String(), "\n", 3)
+	if len(lines) != 3 {
+		log.Infof("%#v identify return %#v\n", c.Addr, b.String())
+		return
+	}
+
+	files := SplitFgrepOutput(lines[2])
+
+	uname := map[string]string{
+		"version":    strings.TrimSpace(lines[1]),
+		"domainname": strings.TrimSpace(files["/proc/sys/kernel/domainname"]),
+	}
+	if parts := split(strings.TrimSpace(lines[0]), -1); len(parts) == 4 {
+		uname["sysname"] = parts[0]
+		uname["nodename"] = parts[1]
+		uname["release"] = parts[2]
+		uname["machine"] = parts[3]
+	}
+
+	osRelease := files["/etc/os-release"]
+	if osRelease == "" {
+		osRelease = files["/usr/lib/os-release"]
+	}
+	_, kv := (ProcFile{Text: osRelease, Sep: "="}).KV()
+	release := make(map[string]string)
+	for key, value := range kv {
+		release[strings.ToLower(key)] = strings.Trim(value, "\"'")
+	}
+
+	dmi := make(map[string]string)
+	for filename, value := range files {
+		if strings.HasPrefix(filename, "/sys/class/dmi/id/") {
+			name := path.Base(filename)
+			if name == "sys_vendor" {
+				name = "system_vendor"
+			}
+			dmi[name] = strings.TrimSpace(value)
+		}
+	}
+
+	c.uname = uname
+	c.osRelease = release
+	c.dmi = dmi
+	c.machineID = strings.TrimSpace(files["/etc/machine-id"])
+
+	log.Infof("%#v uname is %+v, os-release is %+v\n", c.Addr, c.uname, c.osRelease)
 }
 
 func (c *Client) TimeOffset() time.Duration {
@@ -154,18 +451,20 @@ func (c *Client) TimeOffset() time.Duration {
 func (c *Client) Execute(cmd string) (string, error) {
 	log.Debugf("%T.Execute(%#v)\n", c, cmd)
 
-	if c.client == nil {
-		c.connect()
+	client, err := c.connect()
+	if err != nil {
+		return "", err
 	}
 
 	retry := 2
 	for i := 0; i < retry; i += 1 {
-		session, err := c.client.NewSession()
+		session, err := client.NewSession()
 		if err != nil {
 			if i < retry-1 {
 				log.Infof("NewSession() error: %+v, reconnecting...\n", err)
-				c.client.Close()
-				c.connect()
+				if client, err = c.reconnect(client); err != nil {
+					return "", err
+				}
 				continue
 			}
 			return "", err
@@ -271,6 +570,37 @@ func (pf ProcFile) KVS() ([]string, map[string][]string) {
 	return h, m
 }
 
+// SplitFgrepOutput splits the output of `fgrep "" file1 file2 ...` into file contents.
+func SplitFgrepOutput(s string) map[string]string {
+	m := make(map[string]string)
+	var lastname string
+	var b bytes.Buffer
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		filename := strings.TrimSpace(parts[0])
+		line := parts[1]
+
+		if filename != lastname {
+			if lastname != "" {
+				m[lastname] = b.String()
+			}
+			b.Reset()
+			lastname = filename
+		}
+
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	m[lastname] = b.String()
+	return m
+}
+
 type Metrics struct {
 	Client *Client
 
@@ -284,39 +614,13 @@ func (m *Metrics) PreRead() error {
 
 	cmd := "/bin/fgrep \"\" " + strings.Join(PreReadFileList, " ")
 
-	output, _ := m.Client.Execute(cmd)
-
-	split := func(s string) map[string]string {
-		m := make(map[string]string)
-		var lastname string
-		var b bytes.Buffer
-
-		scanner := bufio.NewScanner(strings.NewReader(s))
-		for scanner.Scan() {
-			parts := strings.SplitN(scanner.Text(), ":", 2)
-			if len(parts) != 2 {
-				continue
-			}
-
-			filename := strings.TrimSpace(parts[0])
-			line := parts[1]
-
-			if filename != lastname {
-				if lastname != "" {
-					m[lastname] = b.String()
-				}
-				b.Reset()
-				lastname = filename
-			}
-
-			b.WriteString(line)
-			b.WriteString("\n")
-		}
-		m[lastname] = b.String()
-		return m
+	output, err := m.Client.Execute(cmd)
+	if _, ok := err.(*ssh.ExitError); ok {
+		// fgrep exits non-zero if some of the files do not exist
+		err = nil
 	}
 
-	m.preread = split(output)
+	m.preread = SplitFgrepOutput(output)
 
 	for _, filename := range PreReadFileList {
 		if _, ok := m.preread[filename]; !ok {
@@ -324,7 +628,7 @@ func (m *Metrics) PreRead() error {
 		}
 	}
 
-	return nil
+	return err
 }
 
 func (m *Metrics) Files() []string {
@@ -380,10 +684,68 @@ func (m *Metrics) PrintInt(labels string, value int64) {
 	}
 }
 
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+// PrintInfo prints an info metric with value 1, labels are sorted and empty values are skipped.
+func (m *Metrics) PrintInfo(labels map[string]string) {
+	nonempty := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if value != "" {
+			nonempty[key] = value
+		}
+	}
+
+	m.PrintInt(FormatLabels(nonempty), 1)
+}
+
 func (m *Metrics) PrintRaw(s string) {
 	m.body.WriteString(s)
 }
 
+func (m *Metrics) CollectInfo() error {
+	c := m.Client
+
+	if len(c.uname) != 0 {
+		m.PrintType("node_uname_info", "gauge", "Labeled system information as provided by the uname system call")
+		m.PrintInfo(c.uname)
+	}
+
+	if len(c.osRelease) != 0 {
+		labels := make(map[string]string)
+		for _, key := range []string{"build_id", "id", "id_like", "image_id", "image_version", "name", "pretty_name", "variant", "variant_id", "version", "version_codename", "version_id"} {
+			labels[key] = c.osRelease[key]
+		}
+		m.PrintType("node_os_info", "gauge", "A metric with a constant '1' value labeled by build_id, id, id_like, image_id, image_version, name, pretty_name, variant, variant_id, version, version_codename, version_id")
+		m.PrintInfo(labels)
+
+		if v, err := strconv.ParseFloat(c.osRelease["version_id"], 64); err == nil {
+			m.PrintType("node_os_version", "gauge", "Metric containing the major.minor part of the OS version")
+			m.PrintFloat(FormatLabels(map[string]string{
+				"id":      c.osRelease["id"],
+				"id_like": c.osRelease["id_like"],
+				"name":    c.osRelease["name"],
+			}), v)
+		}
+	}
+
+	if len(c.dmi) != 0 {
+		m.PrintType("node_dmi_info", "gauge", "A metric with a constant '1' value labeled by bios_date, bios_release, bios_vendor, bios_version, board_asset_tag, board_name, board_serial, board_vendor, board_version, chassis_asset_tag, chassis_serial, chassis_vendor, chassis_version, product_family, product_name, product_serial, product_sku, product_uuid, product_version, system_vendor if provided by DMI")
+		m.PrintInfo(c.dmi)
+	}
+
+	if c.machineID != "" {
+		m.PrintType("node_machine_id_info", "gauge", "A metric with a constant '1' value labeled by the machine-id of the host")
+		m.PrintInfo(map[string]string{"machine_id": c.machineID})
+	}
+
+	if len(Labels) > 0 && LabelsMode == LabelsModeInfo {
+		m.PrintType("remote_node_exporter_target_info", "gauge", "A metric with a constant '1' value labeled by the target labels")
+		m.PrintInfo(Labels)
+	}
+
+	return nil
+}
+
 func (m *Metrics) CollectTime() error {
 	var nsec int64
 	var t time.Time
@@ -576,6 +938,129 @@ func (m *Metrics) CollectVmstat() error {
 	return err
 }
 
+// https://github.com/torvalds/linux/blob/master/include/net/tcp_states.h
+var TCPStates map[string]string = map[string]string{
+	"01": "established",
+	"02": "syn_sent",
+	"03": "syn_recv",
+	"04": "fin_wait1",
+	"05": "fin_wait2",
+	"06": "time_wait",
+	"07": "close",
+	"08": "close_wait",
+	"09": "last_ack",
+	"0A": "listen",
+	"0B": "closing",
+}
+
+// TCPStateNames are the values of TCPStates ordered by state code.
+var TCPStateNames []string = func() []string {
+	codes := make([]string, 0, len(TCPStates))
+	for code := range TCPStates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	names := make([]string, 0, len(codes))
+	for _, code := range codes {
+		names = append(names, TCPStates[code])
+	}
+	return names
+}()
+
+func (m *Metrics) CollectTcpstat() error {
+	s1, err := m.ReadFile("/proc/net/tcp")
+	if err != nil {
+		return err
+	}
+
+	s2, err := m.ReadFile("/proc/net/tcp6")
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[int64]bool)
+	for _, port := range TcpstatPorts {
+		watched[int64(port)] = true
+	}
+
+	states := make(map[string]int64)
+	ports := make(map[int64]map[string]int64)
+	var txQueued, rxQueued int64
+
+	scanner := bufio.NewScanner(strings.NewReader(s1 + s2))
+	for scanner.Scan() {
+		parts := split(strings.TrimSpace(scanner.Text()), -1)
+		if len(parts) < 5 || parts[0] == "sl" {
+			continue
+		}
+
+		state, ok := TCPStates[parts[3]]
+		if !ok {
+			continue
+		}
+		states[state] += 1
+
+		if queues := strings.SplitN(parts[4], ":", 2); len(queues) == 2 {
+			if n, err := strconv.ParseInt(queues[0], 16, 64); err == nil {
+				txQueued += n
+			}
+			if n, err := strconv.ParseInt(queues[1], 16, 64); err == nil {
+				rxQueued += n
+			}
+		}
+
+		if len(watched) == 0 {
+			continue
+		}
+
+		i := strings.LastIndex(parts[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseInt(parts[1][i+1:], 16, 64)
+		if err != nil || !watched[port] {
+			continue
+		}
+		if _, ok := ports[port]; !ok {
+			ports[port] = make(map[string]int64)
+		}
+		ports[port][state] += 1
+	}
+
+	if len(states) == 0 {
+		return nil
+	}
+
+	m.PrintType("node_tcp_connection_states", "gauge", "Number of connection states")
+	for _, state := range TCPStateNames {
+		m.PrintInt(fmt.Sprintf("state=\"%s\"", state), states[state])
+	}
+
+	m.PrintType("node_tcp_transmit_queued_bytes", "gauge", "Sum of bytes in the transmit queues of all sockets")
+	m.PrintInt("", txQueued)
+
+	m.PrintType("node_tcp_receive_queued_bytes", "gauge", "Sum of bytes in the receive queues of all sockets")
+	m.PrintInt("", rxQueued)
+
+	if len(watched) != 0 {
+		m.PrintType("node_tcp_port_connection_states", "gauge", "Number of connection states by local port")
+		watchedPorts := make([]int64, 0, len(watched))
+		for port := range watched {
+			watchedPorts = append(watchedPorts, port)
+		}
+		sort.Slice(watchedPorts, func(i, j int) bool { return watchedPorts[i] < watchedPorts[j] })
+
+		for _, port := range watchedPorts {
+			for _, state := range TCPStateNames {
+				m.PrintInt(fmt.Sprintf("port=\"%d\",state=\"%s\"", port, state), ports[port][state])
+			}
+		}
+	}
+
+	return nil
+}
+
 var CPUModes []string = []string{
 	"user",
 	"nice",
@@ -799,51 +1284,612 @@ func (m *Metrics) CollectMDStat() error {
 	return nil
 }
 
-// https://github.com/prometheus/node_exporter/blob/master/collector/filesystem_linux.go
-const (
-	defIgnoredMountPoints = "^/(sys|proc|dev)($|/)"
-	defIgnoredFSTypes     = "^(sysfs|procfs|autofs|nfs|nfs4|cgroup|fuse\\.lxcfs)$"
-)
+// https://github.com/prometheus/procfs/blob/master/nfs/parse.go
+var NFSProcedures map[string][]string = map[string][]string{
+	"proc2": {
+		"Null", "GetAttr", "SetAttr", "Root", "Lookup", "ReadLink", "Read", "WrCache", "Write",
+		"Create", "Remove", "Rename", "Link", "SymLink", "MkDir", "RmDir", "ReadDir", "FsStat",
+	},
+	"proc3": {
+		"Null", "GetAttr", "SetAttr", "Lookup", "Access", "ReadLink", "Read", "Write", "Create", "MkDir", "SymLink",
+		"MkNod", "Remove", "RmDir", "Rename", "Link", "ReadDir", "ReadDirPlus", "FsStat", "FsInfo", "PathConf", "Commit",
+	},
+	"proc4": {
+		"Null", "Read", "Write", "Commit", "Open", "OpenConfirm", "OpenNoattr", "OpenDowngrade", "Close", "Setattr",
+		"FsInfo", "Renew", "SetClientID", "SetClientIDConfirm", "Lock", "Lockt", "Locku", "Access", "Getattr", "Lookup",
+		"LookupRoot", "Remove", "Rename", "Link", "Symlink", "Create", "Pathconf", "StatFs", "ReadLink", "ReadDir",
+		"ServerCaps", "DelegReturn", "GetACL", "SetACL", "FsLocations", "ReleaseLockowner", "Secinfo", "FsidPresent", "ExchangeID", "CreateSession",
+		"DestroySession", "Sequence", "GetLeaseTime", "ReclaimComplete", "LayoutGet", "GetDeviceInfo", "LayoutCommit", "LayoutReturn", "SecinfoNoName", "TestStateID",
+		"FreeStateID", "GetDeviceList", "BindConnToSession", "DestroyClientID", "Seek", "Allocate", "DeAllocate", "LayoutStats", "Clone", "Copy",
+		"OffloadCancel", "Lookupp", "LayoutError", "CopyNotify",
+	},
+}
 
-type FilesystemInfo struct {
-	MountPoint string
-	FSType     string
-	Device     string
-	Size       int64
-	Used       int64
-	Avail      int64
-	Files      int64
-	FilesFree  int64
+// https://github.com/torvalds/linux/blob/master/include/linux/nfs4.h
+var NFSDv4Operations []string = []string{
+	"", "", "", "Access", "Close", "Commit", "Create", "DelegPurge", "DelegReturn", "GetAttr",
+	"GetFH", "Link", "Lock", "Lockt", "Locku", "Lookup", "LookupRoot", "Nverify", "Open", "OpenAttr",
+	"OpenConfirm", "OpenDgrd", "PutFH", "PutPubFH", "PutRootFH", "Read", "ReadDir", "ReadLink", "Remove", "Rename",
+	"Renew", "RestoreFH", "SaveFH", "SecInfo", "SetAttr", "SetClientID", "SetClientIDConfirm", "Verify", "Write", "RelLockOwner",
+	"BackchannelCtl", "BindConnToSession", "ExchangeID", "CreateSession", "DestroySession", "FreeStateID", "GetDirDelegation", "GetDeviceInfo", "GetDeviceList", "LayoutCommit",
+	"LayoutGet", "LayoutReturn", "SecinfoNoName", "Sequence", "SetSSV", "TestStateID", "WantDelegation", "DestroyClientID", "ReclaimComplete", "Allocate",
+	"Copy", "CopyNotify", "Deallocate", "IOAdvise", "LayoutError", "LayoutStats", "OffloadCancel", "OffloadStatus", "ReadPlus", "Seek",
+	"WriteSame", "Clone",
 }
 
-func (m *Metrics) CollectFilesystem() error {
-	s, err := m.ReadFile("/proc/mounts")
-	if err != nil {
-		return err
+func (m *Metrics) printNFSRequests(kv map[string]string, procs ...string) {
+	for _, proc := range procs {
+		vs := split(kv[proc], -1)
+		if len(vs) < 2 {
+			continue
+		}
+		version := strings.TrimPrefix(proc, "proc")
+		for i, v := range vs[1:] {
+			if i == len(NFSProcedures[proc]) {
+				break
+			}
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				m.PrintInt(fmt.Sprintf("method=\"%s\",proto=\"%s\"", NFSProcedures[proc][i], version), n)
+			}
+		}
 	}
+}
 
-	mountpoints := make(map[string]FilesystemInfo)
+func (m *Metrics) CollectNFS() error {
+	s, err := m.ReadFile("/proc/net/rpc/nfs")
+	if err != nil || s == "" {
+		return err
+	}
 
-	scanner := bufio.NewScanner(strings.NewReader(s))
-	for scanner.Scan() {
-		parts := split(strings.TrimSpace(scanner.Text()), -1)
-		device, mountpoint, fstype := parts[0], parts[1], parts[2]
+	_, kv := (ProcFile{Text: s}).KV()
 
-		if regexp.MustCompile(defIgnoredMountPoints).MatchString(mountpoint) {
-			continue
+	if vs := split(kv["net"], -1); len(vs) >= 4 {
+		m.PrintType("node_nfs_packets_total", "counter", "Total NFS network packets (sent+received) by protocol type")
+		if n, err := strconv.ParseInt(vs[1], 10, 64); err == nil {
+			m.PrintInt("protocol=\"udp\"", n)
 		}
-		if regexp.MustCompile(defIgnoredFSTypes).MatchString(fstype) {
-			continue
+		if n, err := strconv.ParseInt(vs[2], 10, 64); err == nil {
+			m.PrintInt("protocol=\"tcp\"", n)
 		}
-
-		mountpoints[mountpoint] = FilesystemInfo{
-			MountPoint: mountpoint,
-			FSType:     fstype,
-			Device:     device,
+		if n, err := strconv.ParseInt(vs[3], 10, 64); err == nil {
+			m.PrintType("node_nfs_connections_total", "counter", "Total number of NFS TCP connections")
+			m.PrintInt("", n)
 		}
 	}
 
-	cmd := "df"
+	if vs := split(kv["rpc"], -1); len(vs) >= 3 {
+		if n, err := strconv.ParseInt(vs[0], 10, 64); err == nil {
+			m.PrintType("node_nfs_rpcs_total", "counter", "Total number of RPCs performed")
+			m.PrintInt("", n)
+		}
+		if n, err := strconv.ParseInt(vs[1], 10, 64); err == nil {
+			m.PrintType("node_nfs_rpc_retransmissions_total", "counter", "Number of RPC transmissions performed")
+			m.PrintInt("", n)
+		}
+		if n, err := strconv.ParseInt(vs[2], 10, 64); err == nil {
+			m.PrintType("node_nfs_rpc_authentication_refreshes_total", "counter", "Number of RPC authentication refreshes performed")
+			m.PrintInt("", n)
+		}
+	}
+
+	m.PrintType("node_nfs_requests_total", "counter", "Number of NFS procedures invoked")
+	m.printNFSRequests(kv, "proc2", "proc3", "proc4")
+
+	return nil
+}
+
+func (m *Metrics) CollectNFSd() error {
+	s, err := m.ReadFile("/proc/net/rpc/nfsd")
+	if err != nil || s == "" {
+		return err
+	}
+
+	_, kv := (ProcFile{Text: s}).KV()
+
+	printInts := func(key string, metrics ...string) {
+		vs := split(kv[key], -1)
+		for i := 0; i+1 < len(metrics) && i/2 < len(vs); i += 2 {
+			if n, err := strconv.ParseInt(vs[i/2], 10, 64); err == nil {
+				m.PrintType(metrics[i], "counter", metrics[i+1])
+				m.PrintInt("", n)
+			}
+		}
+	}
+
+	printInts("rc",
+		"node_nfsd_reply_cache_hits_total", "Total number of NFSd Reply Cache hits (client lost server response)",
+		"node_nfsd_reply_cache_misses_total", "Total number of NFSd Reply Cache an operation that requires caching (idempotent)",
+		"node_nfsd_reply_cache_nocache_total", "Total number of NFSd Reply Cache non-idempotent operations (rename/delete/...)")
+	printInts("fh",
+		"node_nfsd_file_handles_stale_total", "Total number of NFSd stale file handles")
+	printInts("io",
+		"node_nfsd_disk_bytes_read_total", "Total NFSd bytes read",
+		"node_nfsd_disk_bytes_written_total", "Total NFSd bytes written")
+
+	if vs := split(kv["th"], -1); len(vs) >= 1 {
+		if n, err := strconv.ParseInt(vs[0], 10, 64); err == nil {
+			m.PrintType("node_nfsd_server_threads", "gauge", "Total number of NFSd kernel threads that are running")
+			m.PrintInt("", n)
+		}
+	}
+
+	if vs := split(kv["ra"], -1); len(vs) >= 2 {
+		if n, err := strconv.ParseInt(vs[0], 10, 64); err == nil {
+			m.PrintType("node_nfsd_read_ahead_cache_size_blocks", "gauge", "How large the read ahead cache is in blocks")
+			m.PrintInt("", n)
+		}
+		if n, err := strconv.ParseInt(vs[len(vs)-1], 10, 64); err == nil {
+			m.PrintType("node_nfsd_read_ahead_cache_not_found_total", "counter", "Total number of NFSd read ahead cache not found")
+			m.PrintInt("", n)
+		}
+	}
+
+	if vs := split(kv["net"], -1); len(vs) >= 4 {
+		m.PrintType("node_nfsd_packets_total", "counter", "Total NFSd network packets (sent+received) by protocol type")
+		if n, err := strconv.ParseInt(vs[1], 10, 64); err == nil {
+			m.PrintInt("proto=\"udp\"", n)
+		}
+		if n, err := strconv.ParseInt(vs[2], 10, 64); err == nil {
+			m.PrintInt("proto=\"tcp\"", n)
+		}
+		if n, err := strconv.ParseInt(vs[3], 10, 64); err == nil {
+			m.PrintType("node_nfsd_connections_total", "counter", "Total number of NFSd TCP connections")
+			m.PrintInt("", n)
+		}
+	}
+
+	if vs := split(kv["rpc"], -1); len(vs) >= 5 {
+		if n, err := strconv.ParseInt(vs[0], 10, 64); err == nil {
+			m.PrintType("node_nfsd_server_rpcs_total", "counter", "Total number of NFSd RPCs")
+			m.PrintInt("", n)
+		}
+		m.PrintType("node_nfsd_rpc_errors_total", "counter", "Total number of NFSd RPC errors by error type")
+		for i, e := range []string{"fmt", "auth", "cInt"} {
+			if n, err := strconv.ParseInt(vs[i+2], 10, 64); err == nil {
+				m.PrintInt(fmt.Sprintf("error=\"%s\"", e), n)
+			}
+		}
+	}
+
+	m.PrintType("node_nfsd_requests_total", "counter", "Total number NFSd Requests by method and protocol")
+	m.printNFSRequests(kv, "proc2", "proc3")
+	if vs := split(kv["proc4ops"], -1); len(vs) >= 2 {
+		for i, v := range vs[1:] {
+			if i == len(NFSDv4Operations) {
+				break
+			}
+			if NFSDv4Operations[i] == "" {
+				continue
+			}
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				m.PrintInt(fmt.Sprintf("method=\"%s\",proto=\"4\"", NFSDv4Operations[i]), n)
+			}
+		}
+	}
+
+	return nil
+}
+
+type NFSMountStats struct {
+	Export     string
+	MountAddr  string
+	Protocol   string
+	Age        int64
+	Bytes      []int64
+	Operations map[string][]int64
+}
+
+// https://github.com/prometheus/node_exporter/blob/master/collector/mountstats_linux.go
+var NFSMountBytesMetrics [][2]string = [][2]string{
+	{"read_bytes_total", "Number of bytes read using the read() syscall"},
+	{"write_bytes_total", "Number of bytes written using the write() syscall"},
+	{"direct_read_bytes_total", "Number of bytes read using the read() syscall in O_DIRECT mode"},
+	{"direct_write_bytes_total", "Number of bytes written using the write() syscall in O_DIRECT mode"},
+	{"total_read_bytes_total", "Number of bytes read from the NFS server, in total"},
+	{"total_write_bytes_total", "Number of bytes written to the NFS server, in total"},
+	{"read_pages_total", "Number of pages read directly via mmap()'d files"},
+	{"write_pages_total", "Number of pages written directly via mmap()'d files"},
+}
+
+var NFSMountOperationMetrics [][2]string = [][2]string{
+	{"requests_total", "Number of requests performed for a given operation"},
+	{"transmissions_total", "Number of times an actual RPC request has been transmitted for a given operation"},
+	{"major_timeouts_total", "Number of times a request has had a major timeout for a given operation"},
+	{"sent_bytes_total", "Number of bytes sent for a given operation, including RPC headers and payload"},
+	{"received_bytes_total", "Number of bytes received for a given operation, including RPC headers and payload"},
+	{"queue_time_seconds_total", "Duration all requests spent queued for transmission for a given operation before they were sent, in seconds"},
+	{"response_time_seconds_total", "Duration all requests took to get a reply back after a request for a given operation was transmitted, in seconds"},
+	{"request_time_seconds_total", "Duration all requests took from when a request was enqueued to when it was completely handled for a given operation, in seconds"},
+}
+
+func (m *Metrics) CollectMountstats() error {
+	s, err := m.ReadFile("/proc/self/mountstats")
+	if err != nil {
+		return err
+	}
+
+	mounts := make([]*NFSMountStats, 0)
+	var mount *NFSMountStats
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		parts := split(strings.TrimSpace(scanner.Text()), -1)
+		if len(parts) < 2 {
+			continue
+		}
+
+		if parts[0] == "device" {
+			mount = nil
+			// device 192.168.1.1:/srv mounted on /mnt/nfs with fstype nfs4 statvers=1.1
+			if len(parts) >= 8 && strings.HasPrefix(parts[7], "nfs") {
+				mount = &NFSMountStats{
+					Export:     parts[1],
+					Operations: make(map[string][]int64),
+				}
+				mounts = append(mounts, mount)
+			}
+			continue
+		}
+
+		if mount == nil {
+			continue
+		}
+
+		switch key := strings.TrimSuffix(parts[0], ":"); key {
+		case "opts":
+			for _, opt := range strings.Split(parts[1], ",") {
+				kv := strings.SplitN(opt, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				switch kv[0] {
+				case "mountaddr":
+					mount.MountAddr = kv[1]
+				case "proto":
+					mount.Protocol = kv[1]
+				}
+			}
+		case "age":
+			mount.Age, _ = strconv.ParseInt(parts[1], 10, 64)
+		case "bytes":
+			for _, v := range parts[1:] {
+				n, _ := strconv.ParseInt(v, 10, 64)
+				mount.Bytes = append(mount.Bytes, n)
+			}
+		default:
+			if key == strings.ToUpper(key) && len(parts) >= 9 {
+				values := make([]int64, 0, 8)
+				for _, v := range parts[1:9] {
+					n, _ := strconv.ParseInt(v, 10, 64)
+					values = append(values, n)
+				}
+				mount.Operations[key] = values
+			}
+		}
+	}
+
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	labels := func(mount *NFSMountStats) string {
+		return FormatLabels(map[string]string{
+			"export":    mount.Export,
+			"mountaddr": mount.MountAddr,
+			"protocol":  mount.Protocol,
+		})
+	}
+
+	m.PrintType("node_mountstats_nfs_age_seconds_total", "counter", "The age of the NFS mount in seconds")
+	for _, mount := range mounts {
+		m.PrintInt(labels(mount), mount.Age)
+	}
+
+	for i, metric := range NFSMountBytesMetrics {
+		m.PrintType("node_mountstats_nfs_"+metric[0], "counter", metric[1])
+		for _, mount := range mounts {
+			if i < len(mount.Bytes) {
+				m.PrintInt(labels(mount), mount.Bytes[i])
+			}
+		}
+	}
+
+	for i, metric := range NFSMountOperationMetrics {
+		m.PrintType("node_mountstats_nfs_operations_"+metric[0], "counter", metric[1])
+		for _, mount := range mounts {
+			ops := make([]string, 0, len(mount.Operations))
+			for op := range mount.Operations {
+				ops = append(ops, op)
+			}
+			sort.Strings(ops)
+
+			for _, op := range ops {
+				values := mount.Operations[op]
+				if strings.HasSuffix(metric[0], "_seconds_total") {
+					m.PrintFloat(fmt.Sprintf("%s,operation=\"%s\"", labels(mount), op), float64(values[i])/1000)
+				} else {
+					m.PrintInt(fmt.Sprintf("%s,operation=\"%s\"", labels(mount), op), values[i])
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// https://github.com/prometheus/node_exporter/blob/master/collector/zfs_linux.go
+const ZFSKstatPath = "/proc/spl/kstat/zfs/"
+
+var ZFSPoolStates []string = []string{
+	"online",
+	"degraded",
+	"faulted",
+	"offline",
+	"removed",
+	"unavail",
+	"suspended",
+}
+
+func (m *Metrics) CollectZFS() error {
+	arcstats, err := m.ReadFile(ZFSKstatPath + "arcstats")
+	if err != nil || arcstats == "" {
+		return err
+	}
+
+	cmd := "zpool list -Hp -o name,size,alloc,free,frag,cap,dedup,health"
+	if m.Client.hasTimeout {
+		cmd = "timeout 3 " + cmd
+	}
+
+	zpoolList, err := m.Client.Execute(cmd)
+	if err != nil && zpoolList == "" {
+		log.Debugf("%T.Execute(%#v) error: %+v\n", m.Client, cmd, err)
+	}
+
+	m.printZFS(arcstats, zpoolList)
+
+	return nil
+}
+
+// printZFS prints the arcstats, the pool kstats of m.Files() and the output
+// of zpool list.
+func (m *Metrics) printZFS(arcstats, zpoolList string) {
+	_, kv := (ProcFile{Text: arcstats, SkipRows: 2}).KV()
+	for key, value := range kv {
+		vs := split(value, -1)
+		n, err := strconv.ParseInt(vs[len(vs)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		m.PrintType(fmt.Sprintf("node_zfs_arc_%s", key), "untyped", "")
+		m.PrintInt("", n)
+	}
+
+	pools := make(map[string]map[string]int64)
+	states := make(map[string]string)
+	for _, filename := range m.Files() {
+		if !strings.HasPrefix(filename, ZFSKstatPath) {
+			continue
+		}
+		pool, name := path.Split(strings.TrimPrefix(filename, ZFSKstatPath))
+		pool = strings.TrimSuffix(pool, "/")
+		if pool == "" || strings.Contains(pool, "*") {
+			continue
+		}
+
+		s, _ := m.ReadFile(filename)
+		switch name {
+		case "io":
+			hs, kv := (ProcFile{Text: s, SkipRows: 2}).KV()
+			if len(hs) != 2 || len(kv) != 1 {
+				continue
+			}
+			names := split(strings.TrimSpace(hs[1]), -1)
+			for key, value := range kv {
+				values := append([]string{key}, split(value, -1)...)
+				pools[pool] = make(map[string]int64)
+				for i, v := range values {
+					if i == len(names) {
+						break
+					}
+					if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+						pools[pool][names[i]] = n
+					}
+				}
+			}
+		case "state":
+			states[pool] = strings.ToLower(strings.TrimSpace(s))
+		}
+	}
+
+	for _, name := range []string{"nread", "nwritten", "reads", "writes", "wtime", "wlentime", "wupdate", "rtime", "rlentime", "rupdate", "wcnt", "rcnt"} {
+		m.PrintType(fmt.Sprintf("node_zfs_zpool_%s", name), "untyped", "")
+		for pool, values := range pools {
+			if n, ok := values[name]; ok {
+				m.PrintInt(fmt.Sprintf("zpool=\"%s\"", pool), n)
+			}
+		}
+	}
+
+	lists := make(map[string][]string)
+	scanner := bufio.NewScanner(strings.NewReader(zpoolList))
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(parts) != 8 {
+			continue
+		}
+		lists[parts[0]] = parts[1:]
+		if _, ok := states[parts[0]]; !ok {
+			states[parts[0]] = strings.ToLower(parts[7])
+		}
+	}
+
+	m.PrintType("node_zfs_zpool_state", "gauge", "kstat.zfs.misc.state")
+	for pool, state := range states {
+		for _, s := range ZFSPoolStates {
+			n := int64(0)
+			if s == state {
+				n = 1
+			}
+			m.PrintInt(fmt.Sprintf("state=\"%s\",zpool=\"%s\"", s, pool), n)
+		}
+	}
+
+	for i, metric := range [][2]string{
+		{"node_zfs_zpool_size_bytes", "Total size of the ZFS pool"},
+		{"node_zfs_zpool_allocated_bytes", "Amount of storage space used within the ZFS pool"},
+		{"node_zfs_zpool_free_bytes", "The amount of free space available in the ZFS pool"},
+		{"node_zfs_zpool_fragmentation_ratio", "The fragmentation ratio of the ZFS pool"},
+		{"node_zfs_zpool_capacity_ratio", "The ratio of used space to total space of the ZFS pool"},
+		{"node_zfs_zpool_dedup_ratio", "The ratio of deduplicated size vs undeduplicated size for data in the ZFS pool"},
+	} {
+		m.PrintType(metric[0], "gauge", metric[1])
+		for pool, values := range lists {
+			n, err := strconv.ParseFloat(values[i], 64)
+			if err != nil {
+				continue
+			}
+			if strings.HasSuffix(metric[0], "_ratio") && metric[0] != "node_zfs_zpool_dedup_ratio" {
+				n /= 100
+			}
+			m.PrintFloat(fmt.Sprintf("zpool=\"%s\"", pool), n)
+		}
+	}
+}
+
+// https://github.com/prometheus/node_exporter/blob/master/collector/btrfs_linux.go
+const BtrfsSysPath = "/sys/fs/btrfs/"
+
+func (m *Metrics) CollectBtrfs() error {
+	labels := make(map[string]string)
+	allocations := make(map[string]map[string]map[string]int64)
+	devices := make(map[string]map[string]int64)
+	globalRsv := make(map[string]int64)
+
+	for _, filename := range m.Files() {
+		if !strings.HasPrefix(filename, BtrfsSysPath) || strings.Contains(filename, "*") {
+			continue
+		}
+
+		parts := strings.Split(strings.TrimPrefix(filename, BtrfsSysPath), "/")
+		uuid := parts[0]
+
+		s, _ := m.ReadFile(filename)
+		s = strings.TrimSpace(s)
+		if len(parts) == 2 && parts[1] == "label" {
+			labels[uuid] = s
+			continue
+		}
+
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case len(parts) == 3 && parts[1] == "allocation" && parts[2] == "global_rsv_size":
+			globalRsv[uuid] = n
+		case len(parts) == 4 && parts[1] == "allocation":
+			if _, ok := allocations[uuid]; !ok {
+				allocations[uuid] = make(map[string]map[string]int64)
+			}
+			if _, ok := allocations[uuid][parts[2]]; !ok {
+				allocations[uuid][parts[2]] = make(map[string]int64)
+			}
+			allocations[uuid][parts[2]][parts[3]] = n
+		case len(parts) == 4 && parts[1] == "devices" && parts[3] == "size":
+			if _, ok := devices[uuid]; !ok {
+				devices[uuid] = make(map[string]int64)
+			}
+			// sysfs reports device size in 512-byte sectors
+			devices[uuid][parts[2]] = n * 512
+		}
+	}
+
+	if len(labels) == 0 && len(allocations) == 0 {
+		return nil
+	}
+
+	m.PrintType("node_btrfs_info", "gauge", "Filesystem information")
+	for uuid, label := range labels {
+		m.PrintInt(fmt.Sprintf("label=\"%s\",uuid=\"%s\"", labelValueEscaper.Replace(label), labelValueEscaper.Replace(uuid)), 1)
+	}
+
+	m.PrintType("node_btrfs_global_rsv_size_bytes", "gauge", "Size of global reserve")
+	for uuid, n := range globalRsv {
+		m.PrintInt(fmt.Sprintf("uuid=\"%s\"", labelValueEscaper.Replace(uuid)), n)
+	}
+
+	for _, metric := range [][3]string{
+		{"node_btrfs_size_bytes", "total_bytes", "Amount of space allocated for a layout/data type"},
+		{"node_btrfs_used_bytes", "bytes_used", "Amount of used space by a layout/data type"},
+		{"node_btrfs_reserved_bytes", "bytes_reserved", "Amount of space reserved for a data type"},
+	} {
+		m.PrintType(metric[0], "gauge", metric[2])
+		for uuid, types := range allocations {
+			for typ, values := range types {
+				if n, ok := values[metric[1]]; ok {
+					m.PrintInt(fmt.Sprintf("block_group_type=\"%s\",uuid=\"%s\"", labelValueEscaper.Replace(typ), labelValueEscaper.Replace(uuid)), n)
+				}
+			}
+		}
+	}
+
+	m.PrintType("node_btrfs_device_size_bytes", "gauge", "Size of a device that is part of the filesystem")
+	for uuid, values := range devices {
+		for device, n := range values {
+			m.PrintInt(fmt.Sprintf("device=\"%s\",uuid=\"%s\"", labelValueEscaper.Replace(device), labelValueEscaper.Replace(uuid)), n)
+		}
+	}
+
+	return nil
+}
+
+// https://github.com/prometheus/node_exporter/blob/master/collector/filesystem_linux.go
+const (
+	defIgnoredMountPoints = "^/(sys|proc|dev)($|/)"
+	defIgnoredFSTypes     = "^(sysfs|procfs|autofs|nfs|nfs4|cgroup|fuse\\.lxcfs)$"
+)
+
+type FilesystemInfo struct {
+	MountPoint string
+	FSType     string
+	Device     string
+	Size       int64
+	Used       int64
+	Avail      int64
+	Files      int64
+	FilesFree  int64
+}
+
+func (m *Metrics) CollectFilesystem() error {
+	s, err := m.ReadFile("/proc/mounts")
+	if err != nil {
+		return err
+	}
+
+	mountpoints := make(map[string]FilesystemInfo)
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		parts := split(strings.TrimSpace(scanner.Text()), -1)
+		device, mountpoint, fstype := parts[0], parts[1], parts[2]
+
+		if regexp.MustCompile(defIgnoredMountPoints).MatchString(mountpoint) {
+			continue
+		}
+		if regexp.MustCompile(defIgnoredFSTypes).MatchString(fstype) {
+			continue
+		}
+
+		mountpoints[mountpoint] = FilesystemInfo{
+			MountPoint: mountpoint,
+			FSType:     fstype,
+			Device:     device,
+		}
+	}
+
+	cmd := "df"
 	if m.Client.hasTimeout {
 		cmd = "timeout 3 df"
 	}
@@ -858,153 +1904,884 @@ func (m *Metrics) CollectFilesystem() error {
 		return err
 	}
 
-	if s == "" {
-		return fmt.Errorf("df timed out")
+	if s == "" {
+		return fmt.Errorf("df timed out")
+	}
+
+	scanner = bufio.NewScanner(strings.NewReader(s))
+	isInodesLine := false
+	for scanner.Scan() {
+		parts := split(strings.TrimSpace(scanner.Text()), -1)
+
+		if parts[0] == "Filesystem" {
+			isInodesLine = parts[1] == "Inodes"
+			continue
+		}
+
+		size, used, avail, mountpoint := parts[1], parts[2], parts[3], parts[5]
+
+		fi, ok := mountpoints[mountpoint]
+		if !ok {
+			continue
+		}
+
+		if n, err := strconv.ParseInt(size, 10, 64); err == nil {
+			if !isInodesLine {
+				fi.Size = n * 1024
+			} else {
+				fi.Files = n
+			}
+		}
+		if n, err := strconv.ParseInt(used, 10, 64); err == nil {
+			if !isInodesLine {
+				fi.Used = n * 1024
+			}
+		}
+		if n, err := strconv.ParseInt(avail, 10, 64); err == nil {
+			if !isInodesLine {
+				fi.Avail = n * 1024
+			} else {
+				fi.FilesFree = n
+			}
+		}
+
+		mountpoints[mountpoint] = fi
+	}
+
+	m.PrintType("node_filesystem_size", "gauge", "Filesystem size in bytes")
+	for _, fi := range mountpoints {
+		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Size)
+	}
+
+	m.PrintType("node_filesystem_free", "gauge", "Filesystem free space in bytes")
+	for _, fi := range mountpoints {
+		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Size-fi.Used)
+	}
+
+	m.PrintType("node_filesystem_avail", "gauge", "Filesystem space available to non-root users in bytes")
+	for _, fi := range mountpoints {
+		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Avail)
+	}
+
+	m.PrintType("node_filesystem_files", "gauge", "Filesystem inodes number")
+	for _, fi := range mountpoints {
+		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Files)
+	}
+
+	m.PrintType("node_filesystem_files_free", "gauge", "Filesystem inodes free number")
+	for _, fi := range mountpoints {
+		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.FilesFree)
+	}
+
+	return nil
+}
+
+type SmartctlDevice struct {
+	Device struct {
+		Name     string `json:"name"`
+		Protocol string `json:"protocol"`
+	} `json:"device"`
+	ModelName       string `json:"model_name"`
+	SerialNumber    string `json:"serial_number"`
+	FirmwareVersion string `json:"firmware_version"`
+	SmartStatus     *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current int64 `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime *struct {
+		Hours   int64 `json:"hours"`
+		Minutes int64 `json:"minutes"`
+	} `json:"power_on_time"`
+	AtaSmartAttributes struct {
+		Table []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+			Raw  struct {
+				Value int64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NvmeSmartHealthInformationLog *struct {
+		PercentageUsed int64 `json:"percentage_used"`
+		MediaErrors    int64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+func (m *Metrics) CollectSmartctl() error {
+	if !Smartctl {
+		return nil
+	}
+
+	c := m.Client
+	c.smartctlMu.Lock()
+	defer c.smartctlMu.Unlock()
+
+	// failed runs are cached as well, so smartctl runs at most once per interval
+	if !c.smartctlTime.IsZero() && time.Since(c.smartctlTime) < SmartctlInterval {
+		m.PrintRaw(c.smartctl)
+		return c.smartctlErr
+	}
+
+	smartctl := "smartctl"
+	if SmartctlSudo {
+		smartctl = "sudo -n smartctl"
+	}
+
+	s, err := c.Execute(smartctl + " --scan-open")
+	if s == "" {
+		c.smartctl = ""
+		c.smartctlErr = fmt.Errorf("%s --scan-open error: %+v", smartctl, err)
+		c.smartctlTime = time.Now()
+		return c.smartctlErr
+	}
+
+	devices := make([]SmartctlDevice, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		// /dev/sda -d sat # /dev/sda [SAT], ATA device
+		args := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if !strings.HasPrefix(args, "/dev/") {
+			continue
+		}
+
+		output, err := m.Client.Execute(smartctl + " -j -a " + args)
+		if output == "" {
+			log.Infof("%s -j -a %s error: %+v\n", smartctl, args, err)
+			continue
+		}
+
+		var device SmartctlDevice
+		if err := json.Unmarshal([]byte(output), &device); err != nil {
+			log.Infof("%s -j -a %s parse error: %+v\n", smartctl, args, err)
+			continue
+		}
+		if device.Device.Name == "" {
+			device.Device.Name = split(args, -1)[0]
+		}
+		devices = append(devices, device)
+	}
+
+	sm := Metrics{Client: m.Client}
+	sm.printSmartctl(devices)
+
+	c.smartctl = sm.body.String()
+	c.smartctlErr = nil
+	c.smartctlTime = time.Now()
+
+	m.PrintRaw(c.smartctl)
+
+	return nil
+}
+
+func (m *Metrics) printSmartctl(devices []SmartctlDevice) {
+	name := func(d SmartctlDevice) string {
+		return strings.TrimPrefix(d.Device.Name, "/dev/")
+	}
+
+	m.PrintType("smartctl_device", "gauge", "Device info")
+	for _, d := range devices {
+		m.PrintInt(FormatLabels(map[string]string{
+			"device":           name(d),
+			"protocol":         d.Device.Protocol,
+			"model_name":       d.ModelName,
+			"serial_number":    d.SerialNumber,
+			"firmware_version": d.FirmwareVersion,
+		}), 1)
+	}
+
+	m.PrintType("smartctl_device_smart_healthy", "gauge", "General smart status")
+	for _, d := range devices {
+		if d.SmartStatus == nil {
+			continue
+		}
+		n := int64(0)
+		if d.SmartStatus.Passed {
+			n = 1
+		}
+		m.PrintInt(fmt.Sprintf("device=\"%s\"", name(d)), n)
+	}
+
+	m.PrintType("smartctl_device_temperature", "gauge", "Device temperature celsius")
+	for _, d := range devices {
+		if d.Temperature != nil {
+			m.PrintInt(fmt.Sprintf("device=\"%s\",temperature_type=\"current\"", name(d)), d.Temperature.Current)
+		}
+	}
+
+	m.PrintType("smartctl_device_power_on_seconds", "counter", "Device power on seconds")
+	for _, d := range devices {
+		if d.PowerOnTime != nil {
+			m.PrintInt(fmt.Sprintf("device=\"%s\"", name(d)), (d.PowerOnTime.Hours*60+d.PowerOnTime.Minutes)*60)
+		}
+	}
+
+	m.PrintType("smartctl_device_attribute", "gauge", "Device attributes raw value, e.g. Reallocated_Sector_Ct")
+	for _, d := range devices {
+		for _, a := range d.AtaSmartAttributes.Table {
+			m.PrintInt(FormatLabels(map[string]string{
+				"device":               name(d),
+				"attribute_id":         strconv.FormatInt(a.ID, 10),
+				"attribute_name":       a.Name,
+				"attribute_value_type": "raw",
+			}), a.Raw.Value)
+		}
+	}
+
+	m.PrintType("smartctl_device_percentage_used", "gauge", "Device write percentage used")
+	for _, d := range devices {
+		if d.NvmeSmartHealthInformationLog != nil {
+			m.PrintInt(fmt.Sprintf("device=\"%s\"", name(d)), d.NvmeSmartHealthInformationLog.PercentageUsed)
+		}
+	}
+
+	m.PrintType("smartctl_device_media_errors", "counter", "Device media errors")
+	for _, d := range devices {
+		if d.NvmeSmartHealthInformationLog != nil {
+			m.PrintInt(fmt.Sprintf("device=\"%s\"", name(d)), d.NvmeSmartHealthInformationLog.MediaErrors)
+		}
+	}
+}
+
+func (m *Metrics) CollectTextfile() error {
+	for _, name := range m.Files() {
+		if !strings.HasPrefix(name, TextfilePath) {
+			continue
+		}
+		s, err := m.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		m.PrintRaw(string(s))
+	}
+	return nil
+}
+
+func (m *Metrics) CollectScript() error {
+	cmd := fmt.Sprintf("echo %s | base64 -d | gunzip | sh", m.Client.script)
+	output, _ := m.Client.Execute(cmd)
+	m.PrintRaw(output)
+	return nil
+}
+
+// Upstream is an exporter listening on the remote host, e.g. mysqld_exporter
+// bound to 127.0.0.1, which is scraped through the ssh connection.
+type Upstream struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Mode string `json:"mode"`
+}
+
+const (
+	UpstreamModeMerge = "merge"
+	UpstreamModeProxy = "proxy"
+)
+
+var Upstreams []Upstream = func() []Upstream {
+	upstreams := []Upstream{}
+	if s := os.Getenv("EXPORTERS"); s != "" {
+		if err := json.Unmarshal([]byte(s), &upstreams); err != nil {
+			log.Fatalf("unable to parse EXPORTERS %#v: %v", s, err)
+		}
+	}
+	return upstreams
+}()
+
+type UpstreamResult struct {
+	Up       bool
+	Duration time.Duration
+}
+
+// HTTPClient returns a http client which dials through the ssh connection.
+func (c *Client) HTTPClient() *http.Client {
+	c.httpOnce.Do(func() {
+		c.http = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return c.Dial(network, addr)
+				},
+				MaxIdleConnsPerHost: 1,
+				IdleConnTimeout:     time.Minute,
+			},
+			Timeout: 10 * time.Second,
+		}
+	})
+	return c.http
+}
+
+// FetchUpstream requests the upstream exporter and records its up and duration.
+func (c *Client) FetchUpstream(u Upstream) (*http.Response, error) {
+	start := time.Now()
+
+	req, err := http.NewRequest(http.MethodGet, u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+
+	resp, err := c.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("%s returned HTTP status %s", u.URL, resp.Status)
+	}
+
+	c.upstreamsMu.Lock()
+	if c.upstreams == nil {
+		c.upstreams = make(map[string]UpstreamResult)
+	}
+	c.upstreams[u.Name] = UpstreamResult{Up: err == nil, Duration: time.Since(start)}
+	c.upstreamsMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+const (
+	LabelsModeInject = "inject"
+	LabelsModeInfo   = "info"
+)
+
+// Labels are the target labels, injected into every series or exported by
+// remote_node_exporter_target_info depending on LabelsMode.
+var Labels map[string]string = func() map[string]string {
+	labels := map[string]string{}
+	if s := os.Getenv("LABELS"); s != "" {
+		if err := json.Unmarshal([]byte(s), &labels); err != nil {
+			log.Fatalf("unable to parse LABELS %#v: %v", s, err)
+		}
+	}
+	return labels
+}()
+
+var LabelsMode = os.Getenv("LABELS_MODE")
+
+// CollectorLabels are the label names used by the collectors, target labels
+// must not collide with them.
+var CollectorLabels = []string{
+	"attribute_id", "attribute_name", "attribute_value_type", "block_group_type",
+	"bios_date", "bios_release", "bios_vendor", "bios_version",
+	"board_asset_tag", "board_name", "board_serial", "board_vendor", "board_version",
+	"build_id", "chassis_asset_tag", "chassis_serial", "chassis_vendor", "chassis_version",
+	"cpu", "device", "domainname", "error", "export", "exporter", "firmware_version",
+	"forward", "fstype", "id", "id_like", "image_id", "image_version", "label", "le",
+	"machine", "machine_id", "method", "mode", "model_name", "mountaddr", "mountpoint",
+	"name", "nodename", "operation", "port", "pretty_name",
+	"product_family", "product_name", "product_serial", "product_sku", "product_uuid", "product_version",
+	"proto", "protocol", "quantile", "release", "serial_number", "state", "sysname",
+	"system_vendor", "temperature_type", "type", "uuid", "variant", "variant_id",
+	"version", "version_codename", "version_id", "zpool",
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %#v", name)
+		}
+		for _, s := range CollectorLabels {
+			if name == s {
+				return fmt.Errorf("label %#v collides with a collector label", name)
+			}
+		}
+	}
+	return nil
+}
+
+// FormatLabels formats labels sorted by name, e.g. site="a",role="db"
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", key, labelValueEscaper.Replace(labels[key])))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// InjectLabels adds labels to every sample line of a text exposition.
+func InjectLabels(text string, labels string) string {
+	var b bytes.Buffer
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			b.WriteString(line)
+			b.WriteString("\n")
+			continue
+		}
+
+		i := strings.IndexAny(line, "{ \t")
+		switch {
+		case i < 0:
+			b.WriteString(line)
+		case line[i] != '{':
+			b.WriteString(line[:i])
+			b.WriteString("{" + labels + "}")
+			b.WriteString(line[i:])
+		case strings.HasPrefix(line[i:], "{}"):
+			b.WriteString(line[:i+1])
+			b.WriteString(labels)
+			b.WriteString(line[i+1:])
+		default:
+			b.WriteString(line[:i+1])
+			b.WriteString(labels + ",")
+			b.WriteString(line[i+1:])
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// UpstreamPrefix is prepended to the merged upstream families named like the
+// families of the collectors, so that a family is never exposed twice.
+const UpstreamPrefix = "upstream_"
+
+// UpstreamRenamedPrefixes are the family prefixes of the collectors which are
+// renamed with UpstreamPrefix in merged upstreams.
+var UpstreamRenamedPrefixes []string = []string{"node_", "smartctl_"}
+
+// UpstreamDroppedPrefixes are the families about the upstream exporter process
+// rather than the host, every exporter has them so they are dropped.
+var UpstreamDroppedPrefixes []string = []string{"go_", "process_", "promhttp_"}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
 	}
+	return false
+}
 
-	scanner = bufio.NewScanner(strings.NewReader(s))
-	isInodesLine := false
+// MergeUpstream prepares the exposition of a merged upstream for
+// InjectLabels, the families of UpstreamDroppedPrefixes are dropped, those of
+// UpstreamRenamedPrefixes are renamed with UpstreamPrefix and an exporter
+// label is renamed to exported_exporter like prometheus does.
+func MergeUpstream(text string) string {
+	var b bytes.Buffer
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	for scanner.Scan() {
-		parts := split(strings.TrimSpace(scanner.Text()), -1)
+		line := scanner.Text()
 
-		if parts[0] == "Filesystem" {
-			isInodesLine = parts[1] == "Inodes"
-			continue
+		switch {
+		case strings.HasPrefix(line, "# HELP "), strings.HasPrefix(line, "# TYPE "):
+			if hasAnyPrefix(line[7:], UpstreamDroppedPrefixes) {
+				continue
+			}
+			if hasAnyPrefix(line[7:], UpstreamRenamedPrefixes) {
+				line = line[:7] + UpstreamPrefix + line[7:]
+			}
+		case line == "" || line[0] == '#':
+		default:
+			if hasAnyPrefix(line, UpstreamDroppedPrefixes) {
+				continue
+			}
+			if hasAnyPrefix(line, UpstreamRenamedPrefixes) {
+				line = UpstreamPrefix + line
+			}
+			if i := strings.IndexByte(line, '{'); i >= 0 && strings.Contains(line, "exporter=") {
+				line = line[:i] + renameLabel(line[i:], "exporter", "exported_exporter")
+			}
 		}
 
-		size, used, avail, mountpoint := parts[1], parts[2], parts[3], parts[5]
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
 
-		fi, ok := mountpoints[mountpoint]
-		if !ok {
-			continue
+	return b.String()
+}
+
+// MergeFamilies joins the expositions of the merged upstreams, a family
+// exposed by more than one upstream gets a single HELP and TYPE and its
+// samples are grouped together.
+func MergeFamilies(texts []string) string {
+	families := make([]string, 0)
+	helps := make(map[string]string)
+	types := make(map[string]string)
+	samples := make(map[string][]string)
+
+	add := func(family string) {
+		if _, ok := samples[family]; !ok {
+			families = append(families, family)
+			samples[family] = []string{}
 		}
+	}
 
-		if n, err := strconv.ParseInt(size, 10, 64); err == nil {
-			if !isInodesLine {
-				fi.Size = n * 1024
-			} else {
-				fi.Files = n
+	for _, text := range texts {
+		family := ""
+
+		scanner := bufio.NewScanner(strings.NewReader(text))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			if line == "" || line[0] == '#' {
+				fields := strings.SplitN(line, " ", 4)
+				if len(fields) != 4 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+					continue
+				}
+				// the first HELP and TYPE of a family win
+				family = fields[2]
+				add(family)
+				if fields[1] == "HELP" && helps[family] == "" {
+					helps[family] = line
+				}
+				if fields[1] == "TYPE" && types[family] == "" {
+					types[family] = fields[3]
+				}
+				continue
 			}
-		}
-		if n, err := strconv.ParseInt(used, 10, 64); err == nil {
-			if !isInodesLine {
-				fi.Used = n * 1024
+
+			name := line
+			if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+				name = line[:i]
 			}
-		}
-		if n, err := strconv.ParseInt(avail, 10, 64); err == nil {
-			if !isInodesLine {
-				fi.Avail = n * 1024
-			} else {
-				fi.FilesFree = n
+			if name != family && metricFamily(name, types[family]) != family {
+				family = name
+				add(family)
 			}
+			samples[family] = append(samples[family], line)
 		}
+	}
 
-		mountpoints[mountpoint] = fi
+	var b bytes.Buffer
+	for _, family := range families {
+		if helps[family] != "" {
+			b.WriteString(helps[family] + "\n")
+		}
+		if types[family] != "" {
+			b.WriteString(fmt.Sprintf("# TYPE %s %s\n", family, types[family]))
+		}
+		for _, line := range samples[family] {
+			b.WriteString(line + "\n")
+		}
 	}
 
-	m.PrintType("node_filesystem_size", "gauge", "Filesystem size in bytes")
-	for _, fi := range mountpoints {
-		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Size)
+	return b.String()
+}
+
+// renameLabel renames the label name in s, which starts with the opening brace
+// of a sample line.
+func renameLabel(s string, name, newName string) string {
+	var b strings.Builder
+
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			b.WriteByte(c)
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+			continue
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '}':
+			b.WriteString(s[i:])
+			return b.String()
+		case c == '{' || c == ',':
+			rest := strings.TrimLeft(s[i+1:], " ")
+			if strings.HasPrefix(rest, name) && strings.HasPrefix(strings.TrimLeft(rest[len(name):], " "), "=") {
+				b.WriteByte(c)
+				b.WriteString(newName)
+				i += len(s[i+1:]) - len(rest) + len(name)
+				continue
+			}
+		}
+		b.WriteByte(s[i])
 	}
 
-	m.PrintType("node_filesystem_free", "gauge", "Filesystem free space in bytes")
-	for _, fi := range mountpoints {
-		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Size-fi.Used)
+	return b.String()
+}
+
+func (m *Metrics) CollectUpstreams() error {
+	outputs := make([]string, len(Upstreams))
+
+	var wg sync.WaitGroup
+	for i, u := range Upstreams {
+		if u.Mode != "" && u.Mode != UpstreamModeMerge {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, u Upstream) {
+			defer wg.Done()
+			resp, err := m.Client.FetchUpstream(u)
+			if err != nil {
+				log.Infof("%T.FetchUpstream(%#v) error: %+v\n", m.Client, u.URL, err)
+				return
+			}
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				log.Infof("%T.FetchUpstream(%#v) error: %+v\n", m.Client, u.URL, err)
+				return
+			}
+			outputs[i] = InjectLabels(MergeUpstream(string(data)), fmt.Sprintf("exporter=\"%s\"", u.Name))
+		}(i, u)
 	}
+	wg.Wait()
 
-	m.PrintType("node_filesystem_avail", "gauge", "Filesystem space available to non-root users in bytes")
-	for _, fi := range mountpoints {
-		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Avail)
+	m.PrintRaw(MergeFamilies(outputs))
+
+	m.Client.upstreamsMu.Lock()
+	defer m.Client.upstreamsMu.Unlock()
+
+	if len(m.Client.upstreams) == 0 {
+		return nil
 	}
 
-	m.PrintType("node_filesystem_files", "gauge", "Filesystem inodes number")
-	for _, fi := range mountpoints {
-		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.Files)
+	m.PrintType("remote_node_exporter_exporter_up", "gauge", "Whether the last scrape of the remote exporter was successful")
+	for name, result := range m.Client.upstreams {
+		n := int64(0)
+		if result.Up {
+			n = 1
+		}
+		m.PrintInt(fmt.Sprintf("exporter=\"%s\"", name), n)
 	}
 
-	m.PrintType("node_filesystem_files_free", "gauge", "Filesystem inodes free number")
-	for _, fi := range mountpoints {
-		m.PrintInt(fmt.Sprintf("device=\"%s\",fstype=\"%s\",mountpoint=\"%s\"", fi.Device, fi.FSType, fi.MountPoint), fi.FilesFree)
+	m.PrintType("remote_node_exporter_exporter_scrape_duration_seconds", "gauge", "Duration of the last scrape of the remote exporter")
+	for name, result := range m.Client.upstreams {
+		m.PrintFloat(fmt.Sprintf("exporter=\"%s\"", name), result.Duration.Seconds())
 	}
 
 	return nil
 }
 
-func (m *Metrics) CollectTextfile() error {
-	for _, name := range m.Files() {
-		if !strings.HasPrefix(name, TextfilePath) {
+// Collectors are run in order by CollectAll, the names are the keys of
+// COLLECTOR_INTERVALS.
+var Collectors = []struct {
+	Name    string
+	Collect func(*Metrics) error
+}{
+	{"info", (*Metrics).CollectInfo},
+	{"time", (*Metrics).CollectTime},
+	{"loadavg", (*Metrics).CollectLoadavg},
+	{"filefd", (*Metrics).CollectFilefd},
+	{"nf_conntrack", (*Metrics).CollectNfConntrack},
+	{"memory", (*Metrics).CollectMemory},
+	{"netstat", (*Metrics).CollectNetstat},
+	{"sockstat", (*Metrics).CollectSockstat},
+	{"tcpstat", (*Metrics).CollectTcpstat},
+	{"vmstat", (*Metrics).CollectVmstat},
+	{"stat", (*Metrics).CollectStat},
+	{"netdev", (*Metrics).CollectNetdev},
+	{"arp", (*Metrics).CollectArp},
+	{"entropy", (*Metrics).CollectEntropy},
+	{"diskstats", (*Metrics).CollectDiskstats},
+	{"mdstat", (*Metrics).CollectMDStat},
+	{"filesystem", (*Metrics).CollectFilesystem},
+	{"nfs", (*Metrics).CollectNFS},
+	{"nfsd", (*Metrics).CollectNFSd},
+	{"mountstats", (*Metrics).CollectMountstats},
+	{"zfs", (*Metrics).CollectZFS},
+	{"btrfs", (*Metrics).CollectBtrfs},
+	{"smartctl", (*Metrics).CollectSmartctl},
+	{"textfile", (*Metrics).CollectTextfile},
+	{"script", (*Metrics).CollectScript},
+	{"exporters", (*Metrics).CollectUpstreams},
+}
+
+// CollectorIntervals is parsed from COLLECTOR_INTERVALS like zfs=5m,btrfs=5m,
+// the output of such collectors is cached for the interval.
+var CollectorIntervals map[string]time.Duration = func() map[string]time.Duration {
+	intervals := map[string]time.Duration{}
+	for _, s := range strings.Split(os.Getenv("COLLECTOR_INTERVALS"), ",") {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
 			continue
 		}
-		s, err := m.ReadFile(name)
-		if err != nil {
-			return err
+		if d, err := time.ParseDuration(strings.TrimSpace(parts[1])); err == nil && d > 0 {
+			intervals[strings.TrimSpace(parts[0])] = d
 		}
-		m.PrintRaw(string(s))
 	}
-	return nil
-}
+	return intervals
+}()
 
-func (m *Metrics) CollectScript() error {
-	cmd := fmt.Sprintf("echo %s | base64 -d | gunzip | sh", m.Client.script)
-	output, _ := m.Client.Execute(cmd)
-	m.PrintRaw(output)
-	return nil
+type CollectedOutput struct {
+	Body string
+	Time time.Time
 }
 
 func (m *Metrics) CollectAll() (string, error) {
 	var err error
+	start := time.Now()
 
 	err = m.PreRead()
 	if err != nil {
 		log.Infof("%T.PreRead() error: %+v\n", m, err)
 	}
 
-	m.CollectTime()
-	m.CollectLoadavg()
-	m.CollectFilefd()
-	m.CollectNfConntrack()
-	m.CollectMemory()
-	m.CollectNetstat()
-	m.CollectSockstat()
-	m.CollectVmstat()
-	m.CollectStat()
-	m.CollectNetdev()
-	m.CollectArp()
-	m.CollectEntropy()
-	m.CollectDiskstats()
-	m.CollectMDStat()
-	m.CollectFilesystem()
-	m.CollectTextfile()
-	m.CollectScript()
+	m.RunCollectors()
+	m.Client.recordScrape(start, err)
 
 	return m.body.String(), nil
 }
 
-func Forward(lconn net.Conn) {
-	addr := net.JoinHostPort(SshHost, SshPort)
-	config := &ssh.ClientConfig{
-		User: SshUser,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(SshPass),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         8 * time.Second,
+// RunCollectors runs all collectors, a collector with an interval in
+// CollectorIntervals is only run again when its cached output is older.
+func (m *Metrics) RunCollectors() {
+	c := m.Client
+	for _, collector := range Collectors {
+		interval := CollectorIntervals[collector.Name]
+		if interval > 0 {
+			c.collectedMu.Lock()
+			output, ok := c.collected[collector.Name]
+			c.collectedMu.Unlock()
+			if ok && time.Since(output.Time) < interval {
+				m.body.WriteString(output.Body)
+				continue
+			}
+		}
+
+		start := m.body.Len()
+		t := time.Now()
+		err := collector.Collect(m)
+		c.recordCollector(collector.Name, t, err)
+
+		if interval > 0 {
+			c.collectedMu.Lock()
+			if c.collected == nil {
+				c.collected = make(map[string]CollectedOutput)
+			}
+			c.collected[collector.Name] = CollectedOutput{
+				Body: string(m.body.Bytes()[start:]),
+				Time: time.Now(),
+			}
+			c.collectedMu.Unlock()
+		}
 	}
+}
 
-	c, err := ssh.Dial("tcp", addr, config)
-	if err != nil {
-		log.Infof("ssh.Dial(%#v) error: %+v\n", addr, err)
-		return
+var CollectInterval time.Duration = func() time.Duration {
+	d, _ := time.ParseDuration(os.Getenv("COLLECT_INTERVAL"))
+	return d
+}()
+
+var MaxStaleness time.Duration = func() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("MAX_STALENESS"))
+	if err != nil || d <= 0 {
+		d = 3 * CollectInterval
 	}
+	return d
+}()
 
-	rconn, err := c.Dial("tcp", RemoteAddr)
-	if err != nil {
-		log.Infof("%T.Dial(%#v) error: %+v\n", RemoteAddr, err)
-		return
+// Background collects the target every CollectInterval, /metrics serves the
+// last successful result until it is older than MaxStaleness.
+type Background struct {
+	Client *Client
+	Sinks  []Sink
+
+	body     string
+	success  time.Time
+	duration time.Duration
+	mu       sync.Mutex
+}
+
+func (b *Background) Run() {
+	for {
+		start := time.Now()
+
+		m := Metrics{
+			Client: b.Client,
+		}
+
+		err := m.PreRead()
+		if err != nil {
+			log.Infof("%T.PreRead() error: %+v\n", &m, err)
+		} else {
+			m.RunCollectors()
+		}
+		b.Client.recordScrape(start, err)
+
+		b.mu.Lock()
+		b.duration = time.Since(start)
+		if err == nil {
+			b.body = m.body.String()
+			b.success = time.Now()
+		}
+		b.mu.Unlock()
+
+		if err == nil && len(b.Sinks) > 0 {
+			WriteSinks(b.Sinks, m.body.String(), start)
+		}
+
+		if d := CollectInterval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+func (b *Background) Collect() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := Metrics{
+		Client: b.Client,
+	}
+
+	up := !b.success.IsZero() && time.Since(b.success) <= MaxStaleness
+	if up {
+		m.PrintRaw(b.body)
+	}
+
+	m.PrintType("remote_node_exporter_up", "gauge", "Whether the last successful background collection is not older than the max staleness")
+	if up {
+		m.PrintInt("", 1)
+	} else {
+		m.PrintInt("", 0)
+	}
+
+	if !b.success.IsZero() {
+		m.PrintType("remote_node_exporter_last_success_timestamp_seconds", "gauge", "Timestamp of the last successful background collection")
+		// PrintInt would print the timestamp as %e and lose its seconds
+		m.PrintRaw(fmt.Sprintf("remote_node_exporter_last_success_timestamp_seconds %d\n", b.success.Unix()))
+	}
+
+	m.PrintType("remote_node_exporter_collect_duration_seconds", "gauge", "Duration of the last background collection")
+	m.PrintFloat("", b.duration.Seconds())
+
+	return m.body.String()
+}
+
+func portenv(port int) string {
+	if port == 0 {
+		return ""
 	}
+	return strconv.Itoa(port)
+}
+
+func boolenv(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
 
-	go io.Copy(rconn, lconn)
-	io.Copy(lconn, rconn)
+// jsonenv marshals a push output config to an environment value, nil is "".
+func jsonenv(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return "", err
+	}
+	return string(data), nil
 }
 
 func SetProcessName(name string) error {
@@ -1025,35 +2802,78 @@ func main() {
 	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("remote_node_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-
-	log.Infoln("Starting remote_node_exporter", version.Info())
-	log.Infoln("Build context", version.BuildContext())
+	command := kingpin.Parse()
 
-	if SshHost == "" {
-		type Config struct {
-			Exporter []struct {
-				Host   string
-				Port   int
-				User   string
-				Pass   string
-				Key    string
-				Local  int
-				Script string
+	if command == checkConfigCommand.FullCommand() {
+		filenames := *checkConfigFiles
+		if len(filenames) == 0 {
+			filenames = []string{*configFile}
+		}
+		failed := false
+		if *webConfigFile != "" {
+			if _, err := LoadWebConfig(*webConfigFile); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", *webConfigFile, err)
+				failed = true
+			} else {
+				fmt.Printf("%s: OK\n", *webConfigFile)
+			}
+		}
+		for _, filename := range filenames {
+			errs := CheckConfig(filename)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
 			}
-			Forward []struct {
-				Host   string
-				Port   int
-				User   string
-				Pass   string
-				Key    string
-				Local  int
-				Remote string
+			if len(errs) > 0 {
+				fmt.Fprintf(os.Stderr, "%s: %d errors\n", filename, len(errs))
+				failed = true
+			} else {
+				fmt.Printf("%s: OK\n", filename)
 			}
 		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == encryptSecretsCommand.FullCommand() {
+		key, err := LoadSecretsKey(*encryptSecretsKeyFile)
+		if os.IsNotExist(err) {
+			key, err = GenerateSecretsKey(*encryptSecretsKeyFile)
+		}
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		plaintext, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		data, err := EncryptSecrets(plaintext, key)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		os.Stdout.Write(data)
+		return
+	}
+
+	if command == otlpReceiverCommand.FullCommand() {
+		http.HandleFunc("/v1/metrics", HandleOTLP)
+		log.Infof("otlp-receiver listening on %s\n", *otlpReceiverListenAddress)
+		log.Fatal(http.ListenAndServe(*otlpReceiverListenAddress, nil))
+	}
 
-		config := &Config{}
+	// flag values share memory with os.Args which is overwritten by SetProcessName
+	*configFile = string([]byte(*configFile))
+	*masterListenAddress = string([]byte(*masterListenAddress))
+	*sdHost = string([]byte(*sdHost))
+	*sdFile = string([]byte(*sdFile))
+	*webConfigFile = string([]byte(*webConfigFile))
+	*webListenHost = string([]byte(*webListenHost))
 
+	log.Infoln("Starting remote_node_exporter", version.Info())
+	log.Infoln("Build context", version.BuildContext())
+
+	if SshHost == "" {
 		exe, err := os.Executable()
 		if err != nil {
 			log.Fatalf("error: %v", err)
@@ -1064,10 +2884,38 @@ func main() {
 			path.Join(path.Dir(exe), path.Base(*configFile)),
 		}
 
-		var data []byte
+		master := &Master{
+			Exe:             exe,
+			ShutdownTimeout: *shutdownTimeout,
+			WatchConfig:     *configWatch,
+			SDHost:          *sdHost,
+			SDFile:          *sdFile,
+		}
+		if *webConfigFile != "" {
+			if _, err := LoadWebConfig(*webConfigFile); err != nil {
+				log.Fatalf("error: %s: %v", *webConfigFile, err)
+			}
+		}
+		// children inherit the environment of the master
+		WebConfigFile, ListenHost = *webConfigFile, *webListenHost
+		os.Setenv("WEB_CONFIG_FILE", WebConfigFile)
+		os.Setenv("LISTEN_HOST", ListenHost)
+
+		// the status files of the children are only read by the endpoints
+		if *masterListenAddress != "" {
+			if master.StatusDir, err = ioutil.TempDir("", "remote_node_exporter"); err != nil {
+				log.Fatalf("error: %v", err)
+			}
+		}
+
+		if master.SDHost == "" {
+			if master.SDHost, err = os.Hostname(); err != nil {
+				log.Fatalf("error: %v", err)
+			}
+		}
 		for _, filename := range ConfigPaths {
-			data, err = ioutil.ReadFile(filename)
-			if err == nil {
+			if _, err = os.Stat(filename); err == nil {
+				master.ConfigFile = filename
 				break
 			}
 		}
@@ -1075,51 +2923,30 @@ func main() {
 			log.Fatalf("error: read %+v %v", ConfigPaths, err)
 		}
 
-		err = yaml.Unmarshal(data, &config)
-		if err != nil {
+		if err := master.Reload(); err != nil {
 			log.Fatalf("error: %v", err)
 		}
 
-		for _, s := range config.Exporter {
-			if s.Host == "" {
-				log.Fatalf("error: %#v host is empty", s)
-			}
-			if s.Port == 0 {
-				s.Port = 22
-			}
-			cmd := exec.Command(exe)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Env = append(os.Environ(),
-				"SSH_HOST="+s.Host,
-				"SSH_PORT="+strconv.Itoa(s.Port),
-				"SSH_USER="+s.User,
-				"SSH_PASS="+s.Pass,
-				"SSH_KEY="+s.Key,
-				"SSH_SCRIPT="+s.Script,
-				"PORT="+strconv.Itoa(s.Local),
-			)
-			go cmd.Run()
-		}
-
-		for _, s := range config.Forward {
-			if s.Host == "" {
-				log.Fatalf("error: %#v host is empty", s)
-			}
-			if s.Port == 0 {
-				s.Port = 22
-			}
-			cmd := exec.Command(exe)
-			cmd.Env = append(os.Environ(),
-				"SSH_HOST="+s.Host,
-				"SSH_PORT="+strconv.Itoa(s.Port),
-				"SSH_USER="+s.User,
-				"SSH_PASS="+s.Pass,
-				"SSH_KEY="+s.Key,
-				"PORT="+strconv.Itoa(s.Local),
-				"REMOTE_ADDR="+s.Remote,
-			)
-			go cmd.Run()
+		go master.ServeSignals()
+		go master.Refresh()
+		go func() {
+			if master.NeedsWatch() {
+				err := master.Watch()
+				log.Errorf("watch %s error: %+v, polling every %s instead\n", master.ConfigFile, err, PollInterval)
+			}
+			master.Poll()
+		}()
+
+		if *masterListenAddress != "" {
+			http.HandleFunc("/-/reload", master.HandleReload)
+			http.HandleFunc("/-/status", master.HandleStatus)
+			http.HandleFunc("/-/healthy", HandleHealthy)
+			http.HandleFunc("/-/ready", master.HandleReady)
+			http.HandleFunc("/", master.HandleIndex)
+			http.HandleFunc("/sd", master.HandleSD)
+			go func() {
+				log.Fatal(ListenAndServeWeb(*masterListenAddress, nil))
+			}()
 		}
 
 		SetProcessName("remote_node_exporter: master process " + exe)
@@ -1130,24 +2957,12 @@ func main() {
 		SshPort = "22"
 	}
 
-	if RemoteAddr != "" {
-		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s tunneling remote %s", SshUser, SshHost, Port, RemoteAddr))
-		for {
-			ln, err := net.Listen("tcp", ":"+Port)
-			if err != nil {
-				SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s error: %+v", SshUser, SshHost, Port, err))
-				select {}
-			}
-
-			for {
-				conn, err := ln.Accept()
-				if err != nil {
-					time.Sleep(100 * time.Millisecond)
-				}
-				go Forward(conn)
-			}
+	if SshPassFile != "" {
+		data, err := ioutil.ReadFile(SshPassFile)
+		if err != nil {
+			log.Fatalf("unable to read password: %v", err)
 		}
-		return
+		SshPass = strings.TrimRight(string(data), "\r\n")
 	}
 
 	client := &Client{
@@ -1177,6 +2992,55 @@ func main() {
 		client.Config.Auth[0] = ssh.PublicKeys(signer)
 	}
 
+	if StatusFile != "" {
+		go WriteStatus(client, StatusFile)
+	}
+
+	if MetricsPort != "" && (RemoteAddr != "" || ForwardType != "") {
+		name := fmt.Sprintf("%s->%s", Port, RemoteAddr)
+		switch {
+		case ForwardType == "socks":
+			name = Port
+		case ForwardType == "reverse":
+			name = fmt.Sprintf("%s->%s", RemoteAddr, LocalAddr)
+		case LocalAddr != "":
+			name = fmt.Sprintf("%s->%s", LocalAddr, RemoteAddr)
+		}
+		go func() {
+			log.Fatal(ServeForwardMetrics(client, net.JoinHostPort(ListenHost, MetricsPort), name))
+		}()
+	}
+
+	if ForwardType == "socks" {
+		// the proxy reaches everything the target does, so it is local only
+		// unless a listen host is given
+		host := ListenHost
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		laddr := net.JoinHostPort(host, Port)
+		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s socks5 proxy", SshUser, SshHost, laddr))
+		err := ServeSocks(client, laddr)
+		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s error: %+v", SshUser, SshHost, laddr, err))
+		log.Fatalf("ServeSocks(%#v) error: %+v", laddr, err)
+	}
+
+	if RemoteAddr != "" && ForwardType == "reverse" {
+		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] remote listening %s tunneling local %s", SshUser, SshHost, RemoteAddr, LocalAddr))
+		ServeReverse(client, RemoteAddr, LocalAddr)
+	}
+
+	if RemoteAddr != "" {
+		laddr := net.JoinHostPort(ListenHost, Port)
+		if LocalAddr != "" {
+			laddr = LocalAddr
+		}
+		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s tunneling remote %s", SshUser, SshHost, laddr, RemoteAddr))
+		err := ServeForward(client, laddr, RemoteAddr)
+		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s error: %+v", SshUser, SshHost, laddr, err))
+		log.Fatalf("ServeForward(%#v, %#v) error: %+v", laddr, RemoteAddr, err)
+	}
+
 	if SshScript != "" {
 		data, err := ioutil.ReadFile(SshScript)
 		if err != nil {
@@ -1191,17 +3055,47 @@ func main() {
 		client.script = base64.StdEncoding.EncodeToString(b.Bytes())
 	}
 
+	sinks, err := NewSinks(client)
+	if err != nil {
+		log.Fatalf("NewSinks() error: %+v", err)
+	}
+
+	if len(sinks) > 0 && CollectInterval == 0 {
+		log.Fatalf("COLLECT_INTERVAL is required by push outputs")
+	}
+
+	var background *Background
+	if CollectInterval > 0 {
+		background = &Background{Client: client, Sinks: sinks}
+		go background.Run()
+	}
+
+	if len(sinks) > 0 && (Port == "" || Port == "0") {
+		SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] pushing", SshUser, SshHost))
+		select {}
+	}
+
 	http.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
 		m := Metrics{
 			Client: client,
 		}
 
-		s, err := m.CollectAll()
+		var s string
+		var err error
+		if background != nil {
+			s = background.Collect()
+		} else {
+			s, err = m.CollectAll()
+		}
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
 
+		if len(Labels) > 0 && LabelsMode != LabelsModeInfo {
+			s = InjectLabels(s, FormatLabels(Labels))
+		}
+
 		if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
 			rw.Header().Set("Content-Encoding", "gzip")
 			rw.Header().Set("Content-Type", "text/plain")
@@ -1214,17 +3108,53 @@ func main() {
 		}
 	})
 
+	http.HandleFunc("/proxy/", func(rw http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/proxy/")
+		for _, u := range Upstreams {
+			if u.Name != name {
+				continue
+			}
+
+			resp, err := client.FetchUpstream(u)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+
+			rw.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			rw.WriteHeader(resp.StatusCode)
+			io.Copy(rw, resp.Body)
+			return
+		}
+		http.NotFound(rw, req)
+	})
+
+	// connect before the first scrape so that /-/ready reports the target
+	go client.connect()
+
+	http.HandleFunc("/-/healthy", HandleHealthy)
+	http.HandleFunc("/-/ready", HandleReady(client))
+	http.HandleFunc("/-/status", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(client.Status())
+	})
 	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
-		io.WriteString(rw, `<html>
-			<head><title>Node Exporter</title></head>
-			<body>
-			<h1>Node Exporter</h1>
-			<p><a href="/metrics">Metrics</a></p>
-			</body>
-			</html>`)
+		if req.URL.Path != "/" {
+			http.NotFound(rw, req)
+			return
+		}
+		status := client.Status()
+		WriteStatusPage(rw, req, "Node Exporter", []string{"/metrics", "/-/status"}, []ChildStatus{{
+			Name:    fmt.Sprintf("%s@%s listening %s", SshUser, SshHost, Port),
+			State:   "running",
+			Pid:     os.Getpid(),
+			Started: &StartTime,
+			Target:  &status,
+		}})
 	})
 
 	SetProcessName(fmt.Sprintf("remote_node_exporter: [%s@%s] listening %s", SshUser, SshHost, Port))
 
-	log.Fatal(http.ListenAndServe(":"+Port, nil))
+	log.Fatal(ListenAndServeWeb(net.JoinHostPort(ListenHost, Port), nil))
 }
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// exposition sorts the lines of a text exposition, collectors range over
+// maps so only the set of lines is stable.
+func exposition(s string) []string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func checkExposition(t *testing.T, got, want string) {
+	t.Helper()
+
+	g, w := exposition(got), exposition(want)
+	if strings.Join(g, "\n") == strings.Join(w, "\n") {
+		return
+	}
+
+	seen := make(map[string]bool, len(g))
+	for _, line := range g {
+		seen[line] = true
+	}
+	for _, line := range w {
+		if !seen[line] {
+			t.Errorf("missing %s", line)
+		}
+		delete(seen, line)
+	}
+	for _, line := range g {
+		if seen[line] {
+			t.Errorf("unexpected %s", line)
+		}
+	}
+}
+
+const zfsArcstats = `13 1 0x01 96 26112 5843429596 1263722379937
+name                            type data
+hits                            4    8772612
+misses                          4    604635
+size                            4    1073741824
+c_max                           4    2147483648
+`
+
+const zfsPoolIO = `15 3 0x00 1 80 5843429596 1263722379937
+nread    nwritten   reads    writes   wtime    wlentime   wupdate     rtime    rlentime   rupdate     wcnt     rcnt
+1884160  3206144    22       132      7155162  104112268  79210489694 1083672  8226588    79210486948 0        0
+`
+
+const zpoolList = "tank\t1992864825344\t1071237206016\t921627619328\t12\t53\t1.00\tONLINE\n" +
+	"backup\t999922073600\t4218028032\t995704045568\t0\t0\t1.50\tDEGRADED\n"
+
+func TestCollectZFS(t *testing.T) {
+	cases := []struct {
+		name      string
+		files     map[string]string
+		zpoolList string
+		want      string
+	}{
+		{
+			name: "arcstats only",
+			files: map[string]string{
+				"/proc/spl/kstat/zfs/*/io":    "",
+				"/proc/spl/kstat/zfs/*/state": "",
+			},
+			want: `
+# TYPE node_zfs_arc_hits untyped
+node_zfs_arc_hits 8.772612e+06
+# TYPE node_zfs_arc_misses untyped
+node_zfs_arc_misses 604635
+# TYPE node_zfs_arc_size untyped
+node_zfs_arc_size 1.073742e+09
+# TYPE node_zfs_arc_c_max untyped
+node_zfs_arc_c_max 2.147484e+09
+# TYPE node_zfs_zpool_nread untyped
+# TYPE node_zfs_zpool_nwritten untyped
+# TYPE node_zfs_zpool_reads untyped
+# TYPE node_zfs_zpool_writes untyped
+# TYPE node_zfs_zpool_wtime untyped
+# TYPE node_zfs_zpool_wlentime untyped
+# TYPE node_zfs_zpool_wupdate untyped
+# TYPE node_zfs_zpool_rtime untyped
+# TYPE node_zfs_zpool_rlentime untyped
+# TYPE node_zfs_zpool_rupdate untyped
+# TYPE node_zfs_zpool_wcnt untyped
+# TYPE node_zfs_zpool_rcnt untyped
+# HELP node_zfs_zpool_state kstat.zfs.misc.state.
+# TYPE node_zfs_zpool_state gauge
+# HELP node_zfs_zpool_size_bytes Total size of the ZFS pool.
+# TYPE node_zfs_zpool_size_bytes gauge
+# HELP node_zfs_zpool_allocated_bytes Amount of storage space used within the ZFS pool.
+# TYPE node_zfs_zpool_allocated_bytes gauge
+# HELP node_zfs_zpool_free_bytes The amount of free space available in the ZFS pool.
+# TYPE node_zfs_zpool_free_bytes gauge
+# HELP node_zfs_zpool_fragmentation_ratio The fragmentation ratio of the ZFS pool.
+# TYPE node_zfs_zpool_fragmentation_ratio gauge
+# HELP node_zfs_zpool_capacity_ratio The ratio of used space to total space of the ZFS pool.
+# TYPE node_zfs_zpool_capacity_ratio gauge
+# HELP node_zfs_zpool_dedup_ratio The ratio of deduplicated size vs undeduplicated size for data in the ZFS pool.
+# TYPE node_zfs_zpool_dedup_ratio gauge
+`,
+		},
+		{
+			name: "pools",
+			files: map[string]string{
+				"/proc/spl/kstat/zfs/*/io":         "",
+				"/proc/spl/kstat/zfs/*/state":      "",
+				"/proc/spl/kstat/zfs/tank/io":      zfsPoolIO,
+				"/proc/spl/kstat/zfs/tank/state":   "ONLINE\n",
+				"/proc/spl/kstat/zfs/backup/io":    "",
+				"/proc/spl/kstat/zfs/backup/state": "",
+			},
+			zpoolList: zpoolList,
+			want: `
+# TYPE node_zfs_arc_hits untyped
+node_zfs_arc_hits 8.772612e+06
+# TYPE node_zfs_arc_misses untyped
+node_zfs_arc_misses 604635
+# TYPE node_zfs_arc_size untyped
+node_zfs_arc_size 1.073742e+09
+# TYPE node_zfs_arc_c_max untyped
+node_zfs_arc_c_max 2.147484e+09
+# TYPE node_zfs_zpool_nread untyped
+node_zfs_zpool_nread{zpool="tank"} 1.884160e+06
+# TYPE node_zfs_zpool_nwritten untyped
+node_zfs_zpool_nwritten{zpool="tank"} 3.206144e+06
+# TYPE node_zfs_zpool_reads untyped
+node_zfs_zpool_reads{zpool="tank"} 22
+# TYPE node_zfs_zpool_writes untyped
+node_zfs_zpool_writes{zpool="tank"} 132
+# TYPE node_zfs_zpool_wtime untyped
+node_zfs_zpool_wtime{zpool="tank"} 7.155162e+06
+# TYPE node_zfs_zpool_wlentime untyped
+node_zfs_zpool_wlentime{zpool="tank"} 1.041123e+08
+# TYPE node_zfs_zpool_wupdate untyped
+node_zfs_zpool_wupdate{zpool="tank"} 7.921049e+10
+# TYPE node_zfs_zpool_rtime untyped
+node_zfs_zpool_rtime{zpool="tank"} 1.083672e+06
+# TYPE node_zfs_zpool_rlentime untyped
+node_zfs_zpool_rlentime{zpool="tank"} 8.226588e+06
+# TYPE node_zfs_zpool_rupdate untyped
+node_zfs_zpool_rupdate{zpool="tank"} 7.921049e+10
+# TYPE node_zfs_zpool_wcnt untyped
+node_zfs_zpool_wcnt{zpool="tank"} 0
+# TYPE node_zfs_zpool_rcnt untyped
+node_zfs_zpool_rcnt{zpool="tank"} 0
+# HELP node_zfs_zpool_state kstat.zfs.misc.state.
+# TYPE node_zfs_zpool_state gauge
+node_zfs_zpool_state{state="online",zpool="tank"} 1
+node_zfs_zpool_state{state="degraded",zpool="tank"} 0
+node_zfs_zpool_state{state="faulted",zpool="tank"} 0
+node_zfs_zpool_state{state="offline",zpool="tank"} 0
+node_zfs_zpool_state{state="removed",zpool="tank"} 0
+node_zfs_zpool_state{state="unavail",zpool="tank"} 0
+node_zfs_zpool_state{state="suspended",zpool="tank"} 0
+node_zfs_zpool_state{state="online",zpool="backup"} 0
+node_zfs_zpool_state{state="degraded",zpool="backup"} 0
+node_zfs_zpool_state{state="faulted",zpool="backup"} 0
+node_zfs_zpool_state{state="offline",zpool="backup"} 0
+node_zfs_zpool_state{state="removed",zpool="backup"} 0
+node_zfs_zpool_state{state="unavail",zpool="backup"} 0
+node_zfs_zpool_state{state="suspended",zpool="backup"} 0
+# HELP node_zfs_zpool_size_bytes Total size of the ZFS pool.
+# TYPE node_zfs_zpool_size_bytes gauge
+node_zfs_zpool_size_bytes{zpool="tank"} 1.992865e+12
+node_zfs_zpool_size_bytes{zpool="backup"} 9.999221e+11
+# HELP node_zfs_zpool_allocated_bytes Amount of storage space used within the ZFS pool.
+# TYPE node_zfs_zpool_allocated_bytes gauge
+node_zfs_zpool_allocated_bytes{zpool="tank"} 1.071237e+12
+node_zfs_zpool_allocated_bytes{zpool="backup"} 4.218028e+09
+# HELP node_zfs_zpool_free_bytes The amount of free space available in the ZFS pool.
+# TYPE node_zfs_zpool_free_bytes gauge
+node_zfs_zpool_free_bytes{zpool="tank"} 9.216276e+11
+node_zfs_zpool_free_bytes{zpool="backup"} 9.957040e+11
+# HELP node_zfs_zpool_fragmentation_ratio The fragmentation ratio of the ZFS pool.
+# TYPE node_zfs_zpool_fragmentation_ratio gauge
+node_zfs_zpool_fragmentation_ratio{zpool="tank"} 0.120000
+node_zfs_zpool_fragmentation_ratio{zpool="backup"} 0.000000
+# HELP node_zfs_zpool_capacity_ratio The ratio of used space to total space of the ZFS pool.
+# TYPE node_zfs_zpool_capacity_ratio gauge
+node_zfs_zpool_capacity_ratio{zpool="tank"} 0.530000
+node_zfs_zpool_capacity_ratio{zpool="backup"} 0.000000
+# HELP node_zfs_zpool_dedup_ratio The ratio of deduplicated size vs undeduplicated size for data in the ZFS pool.
+# TYPE node_zfs_zpool_dedup_ratio gauge
+node_zfs_zpool_dedup_ratio{zpool="tank"} 1.000000
+node_zfs_zpool_dedup_ratio{zpool="backup"} 1.500000
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Metrics{preread: c.files}
+			m.printZFS(zfsArcstats, c.zpoolList)
+			checkExposition(t, m.body.String(), c.want)
+		})
+	}
+}
+
+func TestCollectBtrfs(t *testing.T) {
+	const uuid = "0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"
+	const sys = "/sys/fs/btrfs/" + uuid + "/"
+
+	cases := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "no btrfs",
+			files: map[string]string{
+				"/sys/fs/btrfs/*/label":                       "",
+				"/sys/fs/btrfs/*/allocation/*/total_bytes":    "",
+				"/sys/fs/btrfs/*/allocation/*/bytes_used":     "",
+				"/sys/fs/btrfs/*/allocation/*/bytes_reserved": "",
+				"/sys/fs/btrfs/*/allocation/global_rsv_size":  "",
+			},
+		},
+		{
+			name: "allocation",
+			files: map[string]string{
+				"/sys/fs/btrfs/*/label":                    "",
+				sys + "label":                              "home \"raid\"\n",
+				sys + "allocation/global_rsv_size":         "16777216\n",
+				sys + "allocation/data/total_bytes":        "10737418240\n",
+				sys + "allocation/data/bytes_used":         "5368709120\n",
+				sys + "allocation/data/bytes_reserved":     "0\n",
+				sys + "allocation/metadata/total_bytes":    "1073741824\n",
+				sys + "allocation/metadata/bytes_used":     "536870912\n",
+				sys + "allocation/metadata/bytes_reserved": "65536\n",
+				sys + "allocation/system/total_bytes":      "8388608\n",
+				sys + "allocation/system/bytes_used":       "16384\n",
+				sys + "allocation/system/bytes_reserved":   "",
+				sys + "devices/sda1/size":                  "41943040\n",
+				sys + "devices/sdb1/size":                  "41943040\n",
+			},
+			want: `
+# HELP node_btrfs_info Filesystem information.
+# TYPE node_btrfs_info gauge
+node_btrfs_info{label="home \"raid\"",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 1
+# HELP node_btrfs_global_rsv_size_bytes Size of global reserve.
+# TYPE node_btrfs_global_rsv_size_bytes gauge
+node_btrfs_global_rsv_size_bytes{uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 1.677722e+07
+# HELP node_btrfs_size_bytes Amount of space allocated for a layout/data type.
+# TYPE node_btrfs_size_bytes gauge
+node_btrfs_size_bytes{block_group_type="data",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 1.073742e+10
+node_btrfs_size_bytes{block_group_type="metadata",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 1.073742e+09
+node_btrfs_size_bytes{block_group_type="system",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 8.388608e+06
+# HELP node_btrfs_used_bytes Amount of used space by a layout/data type.
+# TYPE node_btrfs_used_bytes gauge
+node_btrfs_used_bytes{block_group_type="data",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 5.368709e+09
+node_btrfs_used_bytes{block_group_type="metadata",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 5.368709e+08
+node_btrfs_used_bytes{block_group_type="system",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 16384
+# HELP node_btrfs_reserved_bytes Amount of space reserved for a data type.
+# TYPE node_btrfs_reserved_bytes gauge
+node_btrfs_reserved_bytes{block_group_type="data",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 0
+node_btrfs_reserved_bytes{block_group_type="metadata",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 65536
+# HELP node_btrfs_device_size_bytes Size of a device that is part of the filesystem.
+# TYPE node_btrfs_device_size_bytes gauge
+node_btrfs_device_size_bytes{device="sda1",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 2.147484e+10
+node_btrfs_device_size_bytes{device="sdb1",uuid="0abb23a9-9aa1-4f29-9e8f-4f0a2b1c3d4e"} 2.147484e+10
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Metrics{preread: c.files}
+			if err := m.CollectBtrfs(); err != nil {
+				t.Fatalf("CollectBtrfs() error: %+v", err)
+			}
+			checkExposition(t, m.body.String(), c.want)
+		})
+	}
+}
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 18126 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0CEA 0100007F:D2F4 01 00000010:00000000 00:00000000 00000000   112        0 20583 1 0000000000000000 20 4 30 10 -1
+   2: 0A000001:0016 0A000002:C350 01 00000000:00000020 02:000A3B7E 00000000     0        0 23013 2 0000000000000000 20 4 31 10 -1
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 18128 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000001000000:1F90 00000000000000000000000001000000:A0C2 06 00000000:00000000 03:00000C6A 00000000     0        0 0 3 0000000000000000
+`
+
+func TestCollectTcpstat(t *testing.T) {
+	defer func(ports []int) { TcpstatPorts = ports }(TcpstatPorts)
+
+	cases := []struct {
+		name  string
+		ports []int
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "no sockets",
+			files: map[string]string{
+				"/proc/net/tcp":  "",
+				"/proc/net/tcp6": "",
+			},
+		},
+		{
+			name: "states",
+			files: map[string]string{
+				"/proc/net/tcp":  procNetTCP,
+				"/proc/net/tcp6": procNetTCP6,
+			},
+			want: `
+# HELP node_tcp_connection_states Number of connection states.
+# TYPE node_tcp_connection_states gauge
+node_tcp_connection_states{state="established"} 2
+node_tcp_connection_states{state="syn_sent"} 0
+node_tcp_connection_states{state="syn_recv"} 0
+node_tcp_connection_states{state="fin_wait1"} 0
+node_tcp_connection_states{state="fin_wait2"} 0
+node_tcp_connection_states{state="time_wait"} 1
+node_tcp_connection_states{state="close"} 0
+node_tcp_connection_states{state="close_wait"} 0
+node_tcp_connection_states{state="last_ack"} 0
+node_tcp_connection_states{state="listen"} 2
+node_tcp_connection_states{state="closing"} 0
+# HELP node_tcp_transmit_queued_bytes Sum of bytes in the transmit queues of all sockets.
+# TYPE node_tcp_transmit_queued_bytes gauge
+node_tcp_transmit_queued_bytes 16
+# HELP node_tcp_receive_queued_bytes Sum of bytes in the receive queues of all sockets.
+# TYPE node_tcp_receive_queued_bytes gauge
+node_tcp_receive_queued_bytes 32
+`,
+		},
+		{
+			name:  "watched ports",
+			ports: []int{22, 9100},
+			files: map[string]string{
+				"/proc/net/tcp":  procNetTCP,
+				"/proc/net/tcp6": "",
+			},
+			want: `
+# HELP node_tcp_connection_states Number of connection states.
+# TYPE node_tcp_connection_states gauge
+node_tcp_connection_states{state="established"} 2
+node_tcp_connection_states{state="syn_sent"} 0
+node_tcp_connection_states{state="syn_recv"} 0
+node_tcp_connection_states{state="fin_wait1"} 0
+node_tcp_connection_states{state="fin_wait2"} 0
+node_tcp_connection_states{state="time_wait"} 0
+node_tcp_connection_states{state="close"} 0
+node_tcp_connection_states{state="close_wait"} 0
+node_tcp_connection_states{state="last_ack"} 0
+node_tcp_connection_states{state="listen"} 1
+node_tcp_connection_states{state="closing"} 0
+# HELP node_tcp_transmit_queued_bytes Sum of bytes in the transmit queues of all sockets.
+# TYPE node_tcp_transmit_queued_bytes gauge
+node_tcp_transmit_queued_bytes 16
+# HELP node_tcp_receive_queued_bytes Sum of bytes in the receive queues of all sockets.
+# TYPE node_tcp_receive_queued_bytes gauge
+node_tcp_receive_queued_bytes 32
+# HELP node_tcp_port_connection_states Number of connection states by local port.
+# TYPE node_tcp_port_connection_states gauge
+node_tcp_port_connection_states{port="22",state="established"} 1
+node_tcp_port_connection_states{port="22",state="syn_sent"} 0
+node_tcp_port_connection_states{port="22",state="syn_recv"} 0
+node_tcp_port_connection_states{port="22",state="fin_wait1"} 0
+node_tcp_port_connection_states{port="22",state="fin_wait2"} 0
+node_tcp_port_connection_states{port="22",state="time_wait"} 0
+node_tcp_port_connection_states{port="22",state="close"} 0
+node_tcp_port_connection_states{port="22",state="close_wait"} 0
+node_tcp_port_connection_states{port="22",state="last_ack"} 0
+node_tcp_port_connection_states{port="22",state="listen"} 1
+node_tcp_port_connection_states{port="22",state="closing"} 0
+node_tcp_port_connection_states{port="9100",state="established"} 0
+node_tcp_port_connection_states{port="9100",state="syn_sent"} 0
+node_tcp_port_connection_states{port="9100",state="syn_recv"} 0
+node_tcp_port_connection_states{port="9100",state="fin_wait1"} 0
+node_tcp_port_connection_states{port="9100",state="fin_wait2"} 0
+node_tcp_port_connection_states{port="9100",state="time_wait"} 0
+node_tcp_port_connection_states{port="9100",state="close"} 0
+node_tcp_port_connection_states{port="9100",state="close_wait"} 0
+node_tcp_port_connection_states{port="9100",state="last_ack"} 0
+node_tcp_port_connection_states{port="9100",state="listen"} 0
+node_tcp_port_connection_states{port="9100",state="closing"} 0
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			TcpstatPorts = c.ports
+			m := &Metrics{preread: c.files}
+			if err := m.CollectTcpstat(); err != nil {
+				t.Fatalf("CollectTcpstat() error: %+v", err)
+			}
+			checkExposition(t, m.body.String(), c.want)
+		})
+	}
+}
+
+const procNetRPCNFS = `net 18628 0 18628 6
+rpc 4329 1 4338
+proc3 22 0 1204 3 15
+proc4 61 0 104 26
+`
+
+const procNetRPCNFSd = `rc 0 6 18622
+fh 0 0 0 0 0
+io 157286400 72192
+th 8 0 0.000 0.000 0.000 0.000 0.000 0.000 0.000 0.000 0.000 0.000
+ra 32 0 0 0 0 0 0 0 0 0 0 12
+net 18628 0 18628 6
+rpc 18628 0 0 0 0
+proc3 22 2 112 0 2719
+proc4ops 72 0 0 0 1098 2 0 0 0 0 8179
+`
+
+const procSelfMountstats = `device rootfs mounted on / with fstype rootfs
+device 192.168.1.1:/srv/nfs\040share mounted on /mnt/nfs with fstype nfs statvers=1.1
+	opts:	rw,vers=3,rsize=1048576,wsize=1048576,namlen=255,hard,proto=tcp,timeo=600,retrans=2,sec=sys,mountaddr=192.168.1.1,mountvers=3,mountproto=udp,local_lock=none
+	age:	13968
+	caps:	caps=0x3fc7,wtmult=512,dtsize=32768,bsize=0,namlen=255
+	bytes:	4096 512 0 0 8192 1024 1 0
+	RPC iostats version: 1.0  p/v: 100003/3 (nfs)
+	xprt:	tcp 832 0 1 0 11 6428 6428 0 12154 0 24 26 5726
+	per-op statistics
+	        WRITE: 1 1 0 1148 144 0 10 12
+	         READ: 2 2 0 320 8512 6 90 97
+
+device proc mounted on /proc with fstype proc
+`
+
+func TestCollectNFS(t *testing.T) {
+	m := &Metrics{preread: map[string]string{"/proc/net/rpc/nfs": procNetRPCNFS}}
+	if err := m.CollectNFS(); err != nil {
+		t.Fatalf("CollectNFS() error: %+v", err)
+	}
+	checkExposition(t, m.body.String(), `
+# HELP node_nfs_packets_total Total NFS network packets (sent+received) by protocol type.
+# TYPE node_nfs_packets_total counter
+node_nfs_packets_total{protocol="udp"} 0
+node_nfs_packets_total{protocol="tcp"} 18628
+# HELP node_nfs_connections_total Total number of NFS TCP connections.
+# TYPE node_nfs_connections_total counter
+node_nfs_connections_total 6
+# HELP node_nfs_rpcs_total Total number of RPCs performed.
+# TYPE node_nfs_rpcs_total counter
+node_nfs_rpcs_total 4329
+# HELP node_nfs_rpc_retransmissions_total Number of RPC transmissions performed.
+# TYPE node_nfs_rpc_retransmissions_total counter
+node_nfs_rpc_retransmissions_total 1
+# HELP node_nfs_rpc_authentication_refreshes_total Number of RPC authentication refreshes performed.
+# TYPE node_nfs_rpc_authentication_refreshes_total counter
+node_nfs_rpc_authentication_refreshes_total 4338
+# HELP node_nfs_requests_total Number of NFS procedures invoked.
+# TYPE node_nfs_requests_total counter
+node_nfs_requests_total{method="Null",proto="3"} 0
+node_nfs_requests_total{method="GetAttr",proto="3"} 1204
+node_nfs_requests_total{method="SetAttr",proto="3"} 3
+node_nfs_requests_total{method="Lookup",proto="3"} 15
+node_nfs_requests_total{method="Null",proto="4"} 0
+node_nfs_requests_total{method="Read",proto="4"} 104
+node_nfs_requests_total{method="Write",proto="4"} 26
+`)
+}
+
+func TestCollectNFSd(t *testing.T) {
+	m := &Metrics{preread: map[string]string{"/proc/net/rpc/nfsd": procNetRPCNFSd}}
+	if err := m.CollectNFSd(); err != nil {
+		t.Fatalf("CollectNFSd() error: %+v", err)
+	}
+	checkExposition(t, m.body.String(), `
+# HELP node_nfsd_reply_cache_hits_total Total number of NFSd Reply Cache hits (client lost server response).
+# TYPE node_nfsd_reply_cache_hits_total counter
+node_nfsd_reply_cache_hits_total 0
+# HELP node_nfsd_reply_cache_misses_total Total number of NFSd Reply Cache an operation that requires caching (idempotent).
+# TYPE node_nfsd_reply_cache_misses_total counter
+node_nfsd_reply_cache_misses_total 6
+# HELP node_nfsd_reply_cache_nocache_total Total number of NFSd Reply Cache non-idempotent operations (rename/delete/...).
+# TYPE node_nfsd_reply_cache_nocache_total counter
+node_nfsd_reply_cache_nocache_total 18622
+# HELP node_nfsd_file_handles_stale_total Total number of NFSd stale file handles.
+# TYPE node_nfsd_file_handles_stale_total counter
+node_nfsd_file_handles_stale_total 0
+# HELP node_nfsd_disk_bytes_read_total Total NFSd bytes read.
+# TYPE node_nfsd_disk_bytes_read_total counter
+node_nfsd_disk_bytes_read_total 1.572864e+08
+# HELP node_nfsd_disk_bytes_written_total Total NFSd bytes written.
+# TYPE node_nfsd_disk_bytes_written_total counter
+node_nfsd_disk_bytes_written_total 72192
+# HELP node_nfsd_server_threads Total number of NFSd kernel threads that are running.
+# TYPE node_nfsd_server_threads gauge
+node_nfsd_server_threads 8
+# HELP node_nfsd_read_ahead_cache_size_blocks How large the read ahead cache is in blocks.
+# TYPE node_nfsd_read_ahead_cache_size_blocks gauge
+node_nfsd_read_ahead_cache_size_blocks 32
+# HELP node_nfsd_read_ahead_cache_not_found_total Total number of NFSd read ahead cache not found.
+# TYPE node_nfsd_read_ahead_cache_not_found_total counter
+node_nfsd_read_ahead_cache_not_found_total 12
+# HELP node_nfsd_packets_total Total NFSd network packets (sent+received) by protocol type.
+# TYPE node_nfsd_packets_total counter
+node_nfsd_packets_total{proto="udp"} 0
+node_nfsd_packets_total{proto="tcp"} 18628
+# HELP node_nfsd_connections_total Total number of NFSd TCP connections.
+# TYPE node_nfsd_connections_total counter
+node_nfsd_connections_total 6
+# HELP node_nfsd_server_rpcs_total Total number of NFSd RPCs.
+# TYPE node_nfsd_server_rpcs_total counter
+node_nfsd_server_rpcs_total 18628
+# HELP node_nfsd_rpc_errors_total Total number of NFSd RPC errors by error type.
+# TYPE node_nfsd_rpc_errors_total counter
+node_nfsd_rpc_errors_total{error="fmt"} 0
+node_nfsd_rpc_errors_total{error="auth"} 0
+node_nfsd_rpc_errors_total{error="cInt"} 0
+# HELP node_nfsd_requests_total Total number NFSd Requests by method and protocol.
+# TYPE node_nfsd_requests_total counter
+node_nfsd_requests_total{method="Null",proto="3"} 2
+node_nfsd_requests_total{method="GetAttr",proto="3"} 112
+node_nfsd_requests_total{method="SetAttr",proto="3"} 0
+node_nfsd_requests_total{method="Lookup",proto="3"} 2719
+node_nfsd_requests_total{method="Access",proto="4"} 1098
+node_nfsd_requests_total{method="Close",proto="4"} 2
+node_nfsd_requests_total{method="Commit",proto="4"} 0
+node_nfsd_requests_total{method="Create",proto="4"} 0
+node_nfsd_requests_total{method="DelegPurge",proto="4"} 0
+node_nfsd_requests_total{method="DelegReturn",proto="4"} 0
+node_nfsd_requests_total{method="GetAttr",proto="4"} 8179
+`)
+}
+
+func TestCollectMountstats(t *testing.T) {
+	m := &Metrics{preread: map[string]string{"/proc/self/mountstats": procSelfMountstats}}
+	if err := m.CollectMountstats(); err != nil {
+		t.Fatalf("CollectMountstats() error: %+v", err)
+	}
+	checkExposition(t, m.body.String(), `
+# HELP node_mountstats_nfs_age_seconds_total The age of the NFS mount in seconds.
+# TYPE node_mountstats_nfs_age_seconds_total counter
+node_mountstats_nfs_age_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 13968
+# HELP node_mountstats_nfs_read_bytes_total Number of bytes read using the read() syscall.
+# TYPE node_mountstats_nfs_read_bytes_total counter
+node_mountstats_nfs_read_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 4096
+# HELP node_mountstats_nfs_write_bytes_total Number of bytes written using the write() syscall.
+# TYPE node_mountstats_nfs_write_bytes_total counter
+node_mountstats_nfs_write_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 512
+# HELP node_mountstats_nfs_direct_read_bytes_total Number of bytes read using the read() syscall in O_DIRECT mode.
+# TYPE node_mountstats_nfs_direct_read_bytes_total counter
+node_mountstats_nfs_direct_read_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 0
+# HELP node_mountstats_nfs_direct_write_bytes_total Number of bytes written using the write() syscall in O_DIRECT mode.
+# TYPE node_mountstats_nfs_direct_write_bytes_total counter
+node_mountstats_nfs_direct_write_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 0
+# HELP node_mountstats_nfs_total_read_bytes_total Number of bytes read from the NFS server, in total.
+# TYPE node_mountstats_nfs_total_read_bytes_total counter
+node_mountstats_nfs_total_read_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 8192
+# HELP node_mountstats_nfs_total_write_bytes_total Number of bytes written to the NFS server, in total.
+# TYPE node_mountstats_nfs_total_write_bytes_total counter
+node_mountstats_nfs_total_write_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 1024
+# HELP node_mountstats_nfs_read_pages_total Number of pages read directly via mmap()'d files.
+# TYPE node_mountstats_nfs_read_pages_total counter
+node_mountstats_nfs_read_pages_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 1
+# HELP node_mountstats_nfs_write_pages_total Number of pages written directly via mmap()'d files.
+# TYPE node_mountstats_nfs_write_pages_total counter
+node_mountstats_nfs_write_pages_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp"} 0
+# HELP node_mountstats_nfs_operations_requests_total Number of requests performed for a given operation.
+# TYPE node_mountstats_nfs_operations_requests_total counter
+node_mountstats_nfs_operations_requests_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 2
+node_mountstats_nfs_operations_requests_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 1
+# HELP node_mountstats_nfs_operations_transmissions_total Number of times an actual RPC request has been transmitted for a given operation.
+# TYPE node_mountstats_nfs_operations_transmissions_total counter
+node_mountstats_nfs_operations_transmissions_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 2
+node_mountstats_nfs_operations_transmissions_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 1
+# HELP node_mountstats_nfs_operations_major_timeouts_total Number of times a request has had a major timeout for a given operation.
+# TYPE node_mountstats_nfs_operations_major_timeouts_total counter
+node_mountstats_nfs_operations_major_timeouts_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 0
+node_mountstats_nfs_operations_major_timeouts_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 0
+# HELP node_mountstats_nfs_operations_sent_bytes_total Number of bytes sent for a given operation, including RPC headers and payload.
+# TYPE node_mountstats_nfs_operations_sent_bytes_total counter
+node_mountstats_nfs_operations_sent_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 320
+node_mountstats_nfs_operations_sent_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 1148
+# HELP node_mountstats_nfs_operations_received_bytes_total Number of bytes received for a given operation, including RPC headers and payload.
+# TYPE node_mountstats_nfs_operations_received_bytes_total counter
+node_mountstats_nfs_operations_received_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 8512
+node_mountstats_nfs_operations_received_bytes_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 144
+# HELP node_mountstats_nfs_operations_queue_time_seconds_total Duration all requests spent queued for transmission for a given operation before they were sent, in seconds.
+# TYPE node_mountstats_nfs_operations_queue_time_seconds_total counter
+node_mountstats_nfs_operations_queue_time_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 0.006000
+node_mountstats_nfs_operations_queue_time_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 0.000000
+# HELP node_mountstats_nfs_operations_response_time_seconds_total Duration all requests took to get a reply back after a request for a given operation was transmitted, in seconds.
+# TYPE node_mountstats_nfs_operations_response_time_seconds_total counter
+node_mountstats_nfs_operations_response_time_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 0.090000
+node_mountstats_nfs_operations_response_time_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 0.010000
+# HELP node_mountstats_nfs_operations_request_time_seconds_total Duration all requests took from when a request was enqueued to when it was completely handled for a given operation, in seconds.
+# TYPE node_mountstats_nfs_operations_request_time_seconds_total counter
+node_mountstats_nfs_operations_request_time_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="READ"} 0.097000
+node_mountstats_nfs_operations_request_time_seconds_total{export="192.168.1.1:/srv/nfs\\040share",mountaddr="192.168.1.1",protocol="tcp",operation="WRITE"} 0.012000
+`)
+}
+
+// smartctl -j -a output of a SATA disk and a NVMe drive, trimmed to the fields
+// that are collected
+const smartctlSata = `{
+  "device": {"name": "/dev/sda", "info_name": "/dev/sda [SAT]", "type": "sat", "protocol": "ATA"},
+  "model_name": "WDC WD40EFRX-68N32N0 \"RED\"",
+  "serial_number": "WD-WCC7K1234567",
+  "firmware_version": "82.00A82",
+  "smart_status": {"passed": true},
+  "temperature": {"current": 34},
+  "power_on_time": {"hours": 26280, "minutes": 30},
+  "ata_smart_attributes": {
+    "revision": 16,
+    "table": [
+      {"id": 5, "name": "Reallocated_Sector_Ct", "value": 200, "worst": 200, "thresh": 140, "raw": {"value": 0, "string": "0"}},
+      {"id": 194, "name": "Temperature_Celsius", "value": 116, "worst": 104, "thresh": 0, "raw": {"value": 34, "string": "34"}}
+    ]
+  }
+}`
+
+const smartctlNvme = `{
+  "device": {"name": "/dev/nvme0", "info_name": "/dev/nvme0", "type": "nvme", "protocol": "NVMe"},
+  "model_name": "Samsung SSD 970 EVO Plus 1TB",
+  "serial_number": "S4EWNX0N123456",
+  "firmware_version": "2B2QEXM7",
+  "smart_status": {"passed": false},
+  "temperature": {"current": 41},
+  "power_on_time": {"hours": 1200},
+  "nvme_smart_health_information_log": {"critical_warning": 0, "percentage_used": 3, "media_errors": 2}
+}`
+
+func TestCollectSmartctl(t *testing.T) {
+	devices := make([]SmartctlDevice, 0)
+	for _, s := range []string{smartctlSata, smartctlNvme} {
+		var device SmartctlDevice
+		if err := json.Unmarshal([]byte(s), &device); err != nil {
+			t.Fatalf("json.Unmarshal() error: %+v", err)
+		}
+		devices = append(devices, device)
+	}
+
+	m := &Metrics{}
+	m.printSmartctl(devices)
+
+	checkExposition(t, m.body.String(), `
+# HELP smartctl_device Device info.
+# TYPE smartctl_device gauge
+smartctl_device{device="sda",firmware_version="82.00A82",model_name="WDC WD40EFRX-68N32N0 \"RED\"",protocol="ATA",serial_number="WD-WCC7K1234567"} 1
+smartctl_device{device="nvme0",firmware_version="2B2QEXM7",model_name="Samsung SSD 970 EVO Plus 1TB",protocol="NVMe",serial_number="S4EWNX0N123456"} 1
+# HELP smartctl_device_smart_healthy General smart status.
+# TYPE smartctl_device_smart_healthy gauge
+smartctl_device_smart_healthy{device="sda"} 1
+smartctl_device_smart_healthy{device="nvme0"} 0
+# HELP smartctl_device_temperature Device temperature celsius.
+# TYPE smartctl_device_temperature gauge
+smartctl_device_temperature{device="sda",temperature_type="current"} 34
+smartctl_device_temperature{device="nvme0",temperature_type="current"} 41
+# HELP smartctl_device_power_on_seconds Device power on seconds.
+# TYPE smartctl_device_power_on_seconds counter
+smartctl_device_power_on_seconds{device="sda"} 9.460980e+07
+smartctl_device_power_on_seconds{device="nvme0"} 4.320000e+06
+# HELP smartctl_device_attribute Device attributes raw value, e.g. Reallocated_Sector_Ct.
+# TYPE smartctl_device_attribute gauge
+smartctl_device_attribute{attribute_id="5",attribute_name="Reallocated_Sector_Ct",attribute_value_type="raw",device="sda"} 0
+smartctl_device_attribute{attribute_id="194",attribute_name="Temperature_Celsius",attribute_value_type="raw",device="sda"} 34
+# HELP smartctl_device_percentage_used Device write percentage used.
+# TYPE smartctl_device_percentage_used gauge
+smartctl_device_percentage_used{device="nvme0"} 3
+# HELP smartctl_device_media_errors Device media errors.
+# TYPE smartctl_device_media_errors counter
+smartctl_device_media_errors{device="nvme0"} 2
+`)
+}
+
+func TestCollectInfo(t *testing.T) {
+	defer func(labels map[string]string) { Labels = labels }(Labels)
+	Labels = nil
+
+	m := &Metrics{Client: &Client{osRelease: map[string]string{
+		"id":         "rocky",
+		"id_like":    `rhel "centos" fedora`,
+		"name":       `Rocky Linux \ Green`,
+		"version_id": "9.3",
+	}}}
+	if err := m.CollectInfo(); err != nil {
+		t.Fatalf("CollectInfo() error: %+v", err)
+	}
+
+	checkExposition(t, m.body.String(), `
+# HELP node_os_info A metric with a constant '1' value labeled by build_id, id, id_like, image_id, image_version, name, pretty_name, variant, variant_id, version, version_codename, version_id.
+# TYPE node_os_info gauge
+node_os_info{id="rocky",id_like="rhel \"centos\" fedora",name="Rocky Linux \\ Green",version_id="9.3"} 1
+# HELP node_os_version Metric containing the major.minor part of the OS version.
+# TYPE node_os_version gauge
+node_os_version{id="rocky",id_like="rhel \"centos\" fedora",name="Rocky Linux \\ Green"} 9.300000
+`)
+}
+
+func TestRenameLabel(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{`{exporter="a"} 1`, `{exported_exporter="a"} 1`},
+		{`{job="x",exporter="a"} 1`, `{job="x",exported_exporter="a"} 1`},
+		{`{job="x", exporter = "a"} 1`, `{job="x",exported_exporter = "a"} 1`},
+		{`{exporters="a"} 1`, `{exporters="a"} 1`},
+		{`{my_exporter="a"} 1`, `{my_exporter="a"} 1`},
+		{`{query="exporter=\"a\",x",exporter="b"} 1`, `{query="exporter=\"a\",x",exported_exporter="b"} 1`},
+		{`{query="a\",exporter=\"b"} 1`, `{query="a\",exporter=\"b"} 1`},
+		{`{query="a\\",exporter="b"} 1`, `{query="a\\",exported_exporter="b"} 1`},
+		{`{job="x"} 1 # {exporter="a"} 1`, `{job="x"} 1 # {exporter="a"} 1`},
+	}
+
+	for _, c := range cases {
+		if got := renameLabel(c.s, "exporter", "exported_exporter"); got != c.want {
+			t.Errorf("renameLabel(%#q) = %#q, want %#q", c.s, got, c.want)
+		}
+	}
+}
+
+func TestMergeUpstream(t *testing.T) {
+	text := `# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 8
+# HELP process_cpu_seconds_total Total user and system CPU time spent in seconds.
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 0.5
+# TYPE promhttp_metric_handler_requests_total counter
+promhttp_metric_handler_requests_total{code="200"} 3
+# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.25
+# HELP mysql_global_status_queries Queries.
+# TYPE mysql_global_status_queries untyped
+mysql_global_status_queries{exporter="mysqld",query="select 'exporter=1'"} 12
+# some comment
+mysql_up 1
+`
+	want := `# HELP upstream_node_load1 1m load average.
+# TYPE upstream_node_load1 gauge
+upstream_node_load1 0.25
+# HELP mysql_global_status_queries Queries.
+# TYPE mysql_global_status_queries untyped
+mysql_global_status_queries{exported_exporter="mysqld",query="select 'exporter=1'"} 12
+# some comment
+mysql_up 1
+`
+	if got := MergeUpstream(text); got != want {
+		t.Errorf("MergeUpstream() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMergeFamilies(t *testing.T) {
+	texts := []string{
+		`# HELP mysql_up Whether the last scrape was successful.
+# TYPE mysql_up gauge
+mysql_up{exporter="db1"} 1
+# HELP mysql_query_seconds Query latency.
+# TYPE mysql_query_seconds histogram
+mysql_query_seconds_bucket{exporter="db1",le="+Inf"} 3
+mysql_query_seconds_sum{exporter="db1"} 0.3
+mysql_query_seconds_count{exporter="db1"} 3
+`,
+		"",
+		`# HELP mysql_up Whether the scrape was successful.
+# TYPE mysql_up gauge
+mysql_up{exporter="db2"} 0
+nginx_connections{exporter="db2"} 4
+# HELP mysql_query_seconds Query latency.
+# TYPE mysql_query_seconds histogram
+mysql_query_seconds_bucket{exporter="db2",le="+Inf"} 1
+mysql_query_seconds_sum{exporter="db2"} 0.1
+mysql_query_seconds_count{exporter="db2"} 1
+`,
+	}
+	want := `# HELP mysql_up Whether the last scrape was successful.
+# TYPE mysql_up gauge
+mysql_up{exporter="db1"} 1
+mysql_up{exporter="db2"} 0
+# HELP mysql_query_seconds Query latency.
+# TYPE mysql_query_seconds histogram
+mysql_query_seconds_bucket{exporter="db1",le="+Inf"} 3
+mysql_query_seconds_sum{exporter="db1"} 0.3
+mysql_query_seconds_count{exporter="db1"} 3
+mysql_query_seconds_bucket{exporter="db2",le="+Inf"} 1
+mysql_query_seconds_sum{exporter="db2"} 0.1
+mysql_query_seconds_count{exporter="db2"} 1
+nginx_connections{exporter="db2"} 4
+`
+	if got := MergeFamilies(texts); got != want {
+		t.Errorf("MergeFamilies() =\n%s\nwant\n%s", got, want)
+	}
+}
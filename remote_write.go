@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/log"
+)
+
+type RemoteWriteConfig struct {
+	URL         string `yaml:"url" json:"url"`
+	WALDir      string `yaml:"wal_dir" json:"wal_dir,omitempty"`
+	WALMaxBytes int64  `yaml:"wal_max_bytes" json:"wal_max_bytes,omitempty"`
+
+	HTTPAuth `yaml:",inline"`
+}
+
+var RemoteWrite *RemoteWriteConfig = func() *RemoteWriteConfig {
+	s := os.Getenv("REMOTE_WRITE")
+	if s == "" {
+		return nil
+	}
+	config := &RemoteWriteConfig{}
+	if err := json.Unmarshal([]byte(s), config); err != nil {
+		log.Fatalf("unable to parse REMOTE_WRITE %#v: %v", s, err)
+	}
+	return config
+}()
+
+var DefaultWALMaxBytes int64 = 64 << 20
+
+// https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+// https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+//
+// message WriteRequest { repeated TimeSeries timeseries = 1; }
+// message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+// message Label { string name = 1; string value = 2; }
+// message Sample { double value = 1; int64 timestamp = 2; }
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|2))
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendLabel(b []byte, name, value string) []byte {
+	var l []byte
+	l = appendBytesField(l, 1, []byte(name))
+	l = appendBytesField(l, 2, []byte(value))
+	return appendBytesField(b, 1, l)
+}
+
+// EncodeWriteRequest encodes samples as a remote write protobuf WriteRequest.
+func EncodeWriteRequest(samples []Sample, ts time.Time) []byte {
+	var b []byte
+	for _, s := range samples {
+		var series []byte
+
+		// labels must be sorted by name, __name__ sorts before lowercase names
+		labels := append([]Label{{"__name__", s.Name}}, s.Labels...)
+		sort.SliceStable(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+		for _, l := range labels {
+			series = appendLabel(series, l.Name, l.Value)
+		}
+
+		var sample []byte
+		sample = appendVarint(sample, 1<<3|1)
+		sample = append(sample, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(sample[len(sample)-8:], math.Float64bits(s.Value))
+		sample = appendVarint(sample, 2<<3|0)
+		sample = appendVarint(sample, uint64(ts.UnixNano()/int64(time.Millisecond)))
+		series = appendBytesField(series, 2, sample)
+
+		b = appendBytesField(b, 1, series)
+	}
+	return b
+}
+
+// WAL is a bounded queue of snappy compressed write requests, kept as files
+// in Dir so that they survive restarts, or in memory if Dir is empty. The
+// oldest requests are dropped when the queue exceeds MaxBytes.
+type WAL struct {
+	Dir      string
+	MaxBytes int64
+
+	seq    uint64
+	memory []walEntry
+	size   int64
+	mu     sync.Mutex
+	notify chan struct{}
+}
+
+type walEntry struct {
+	seq  uint64
+	data []byte
+}
+
+func NewWAL(dir string, maxBytes int64) (*WAL, error) {
+	w := &WAL{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		notify:   make(chan struct{}, 1),
+	}
+
+	if dir == "" {
+		return w, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// requests being written when the process died
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range tmps {
+		if err := os.Remove(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	seqs, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		if fi, err := os.Stat(w.filename(seq)); err == nil {
+			w.size += fi.Size()
+		}
+		w.seq = seq
+	}
+
+	return w, nil
+}
+
+func (w *WAL) filename(seq uint64) string {
+	return filepath.Join(w.Dir, fmt.Sprintf("%020d.snappy", seq))
+}
+
+// segments returns the sequence numbers of the queued requests, oldest first.
+func (w *WAL) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(w.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0, len(files))
+	for _, fi := range files {
+		if n, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), ".snappy"), 10, 64); err == nil && strings.HasSuffix(fi.Name(), ".snappy") {
+			seqs = append(seqs, n)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	return seqs, nil
+}
+
+func (w *WAL) Append(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	if w.Dir == "" {
+		w.memory = append(w.memory, walEntry{w.seq, data})
+	} else {
+		filename := w.filename(w.seq)
+		if err := ioutil.WriteFile(filename+".tmp", data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(filename+".tmp", filename); err != nil {
+			return err
+		}
+	}
+	w.size += int64(len(data))
+
+	for w.size > w.MaxBytes {
+		seq, _, err := w.peek()
+		if err != nil || seq == 0 {
+			w.size = 0
+			return err
+		}
+		if err := w.remove(seq); err != nil {
+			return err
+		}
+		log.Errorf("%s is full, dropped the oldest request\n", w.name())
+	}
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Peek returns the oldest request and its sequence number, which is 0 if the
+// queue is empty.
+func (w *WAL) Peek() (uint64, []byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.peek()
+}
+
+func (w *WAL) peek() (uint64, []byte, error) {
+	if w.Dir == "" {
+		if len(w.memory) == 0 {
+			return 0, nil, nil
+		}
+		return w.memory[0].seq, w.memory[0].data, nil
+	}
+
+	seqs, err := w.segments()
+	if err != nil || len(seqs) == 0 {
+		return 0, nil, err
+	}
+
+	data, err := ioutil.ReadFile(w.filename(seqs[0]))
+	return seqs[0], data, err
+}
+
+// Remove removes the request seq if it is still queued.
+func (w *WAL) Remove(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.remove(seq)
+}
+
+func (w *WAL) remove(seq uint64) error {
+	if w.Dir == "" {
+		for i, e := range w.memory {
+			if e.seq == seq {
+				w.size -= int64(len(e.data))
+				w.memory = append(w.memory[:i], w.memory[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+
+	filename := w.filename(seq)
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.size -= fi.Size()
+
+	return os.Remove(filename)
+}
+
+func (w *WAL) name() string {
+	if w.Dir == "" {
+		return "remote write queue"
+	}
+	return w.Dir
+}
+
+// RemoteWriteSink appends every collection to its WAL and sends the queued
+// requests in order, retrying with backoff while the receiver is down.
+type RemoteWriteSink struct {
+	Config *RemoteWriteConfig
+
+	wal    *WAL
+	client *http.Client
+}
+
+func NewRemoteWriteSink(config *RemoteWriteConfig) (*RemoteWriteSink, error) {
+	maxBytes := config.WALMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultWALMaxBytes
+	}
+
+	wal, err := NewWAL(config.WALDir, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &RemoteWriteSink{
+		Config: config,
+		wal:    wal,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	go sink.run()
+
+	return sink, nil
+}
+
+func (sink *RemoteWriteSink) Name() string {
+	return "remote_write " + sink.Config.URL
+}
+
+func (sink *RemoteWriteSink) Write(samples []Sample, ts time.Time) error {
+	return sink.wal.Append(snappy.Encode(nil, EncodeWriteRequest(samples, ts)))
+}
+
+func (sink *RemoteWriteSink) run() {
+	backoff := time.Second
+	for {
+		seq, data, err := sink.wal.Peek()
+		if err != nil {
+			log.Errorf("%s peek error: %+v\n", sink.wal.name(), err)
+		}
+		if seq == 0 || err != nil {
+			select {
+			case <-sink.wal.notify:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		retry, err := sink.send(data)
+		if err != nil && retry {
+			log.Errorf("%s error: %+v, retrying in %s\n", sink.Name(), err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > time.Minute {
+				backoff = time.Minute
+			}
+			continue
+		}
+		if err != nil {
+			log.Errorf("%s error: %+v, dropping the request\n", sink.Name(), err)
+		}
+
+		backoff = time.Second
+		if err := sink.wal.Remove(seq); err != nil {
+			log.Errorf("%s remove error: %+v\n", sink.wal.name(), err)
+		}
+	}
+}
+
+// send posts a request, retry reports whether a failed request should be
+// retried, which is the case for network errors, 429 and 5xx responses.
+func (sink *RemoteWriteSink) send(data []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, sink.Config.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "remote_node_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if err := sink.Config.Apply(req); err != nil {
+		return true, err
+	}
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("POST %s: %s %s", sink.Config.URL, resp.Status, bytes.TrimSpace(body))
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// decodeWriteRequest decodes a WriteRequest into lines like
+// __name__="up",job="node" 1 1600000000000
+func decodeWriteRequest(b []byte) ([]string, error) {
+	lines := make([]string, 0)
+	err := readProto(b, func(field int, v uint64, series []byte) error {
+		if field != 1 {
+			return fmt.Errorf("unexpected WriteRequest field %d", field)
+		}
+
+		labels := make([]string, 0)
+		samples := make([]string, 0)
+		err := readProto(series, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				var name, value string
+				err := readProto(data, func(field int, v uint64, data []byte) error {
+					if field == 1 {
+						name = string(data)
+					} else {
+						value = string(data)
+					}
+					return nil
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+				return err
+			case 2:
+				var value float64
+				var ts int64
+				err := readProto(data, func(field int, v uint64, data []byte) error {
+					if field == 1 {
+						value = math.Float64frombits(v)
+					} else {
+						ts = int64(v)
+					}
+					return nil
+				})
+				samples = append(samples, fmt.Sprintf("%g %d", value, ts))
+				return err
+			}
+			return fmt.Errorf("unexpected TimeSeries field %d", field)
+		})
+
+		for _, sample := range samples {
+			lines = append(lines, strings.Join(labels, ",")+" "+sample)
+		}
+		return err
+	})
+
+	return lines, err
+}
+
+// writeReceiver is a stand-in remote write receiver which records the decoded
+// requests.
+type writeReceiver struct {
+	requests [][]string
+	mu       sync.Mutex
+	received chan struct{}
+}
+
+func (r *writeReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(rw, "unexpected headers", http.StatusBadRequest)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines, err := decodeWriteRequest(data)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.requests = append(r.requests, lines)
+	r.received <- struct{}{}
+}
+
+func (r *writeReceiver) wait(t *testing.T, n int) [][]string {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received %d of %d requests", i, n)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.requests
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	samples := []Sample{
+		{Name: "node_load1", Labels: []Label{{"instance", "web1"}, {"job", "node"}}, Value: 0.5},
+		{Name: "node_filesystem_avail_bytes", Labels: []Label{{"Mountpoint", "/"}, {"device", "sda1"}}, Value: 1e10},
+		{Name: "up", Value: 1},
+	}
+	ts := time.Unix(1600000000, 123e6)
+
+	got, err := decodeWriteRequest(EncodeWriteRequest(samples, ts))
+	if err != nil {
+		t.Fatalf("decodeWriteRequest() error: %+v", err)
+	}
+
+	want := []string{
+		`__name__="node_load1",instance="web1",job="node" 0.5 1600000000123`,
+		`Mountpoint="/",__name__="node_filesystem_avail_bytes",device="sda1" 1e+10 1600000000123`,
+		`__name__="up" 1 1600000000123`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EncodeWriteRequest() = %q, want %q", got, want)
+	}
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	receiver := &writeReceiver{received: make(chan struct{}, 16)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	sink, err := NewRemoteWriteSink(&RemoteWriteConfig{URL: server.URL})
+	if err != nil {
+		t.Fatalf("NewRemoteWriteSink() error: %+v", err)
+	}
+
+	ts := time.Unix(1600000000, 0)
+	for i := 0; i < 3; i++ {
+		if err := sink.Write([]Sample{{Name: "up", Labels: []Label{{"instance", "web1"}}, Value: float64(i)}}, ts); err != nil {
+			t.Fatalf("Write() error: %+v", err)
+		}
+	}
+
+	got := receiver.wait(t, 3)
+	want := [][]string{
+		{`__name__="up",instance="web1" 0 1600000000000`},
+		{`__name__="up",instance="web1" 1 1600000000000`},
+		{`__name__="up",instance="web1" 2 1600000000000`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	request := func(i int) []byte {
+		return snappy.Encode(nil, EncodeWriteRequest([]Sample{{Name: "up", Value: float64(i)}}, time.Unix(1600000000+int64(i), 0)))
+	}
+
+	// the requests queued while the receiver was down before a restart, and
+	// one that was being written
+	wal, err := NewWAL(dir, DefaultWALMaxBytes)
+	if err != nil {
+		t.Fatalf("NewWAL() error: %+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := wal.Append(request(i)); err != nil {
+			t.Fatalf("Append() error: %+v", err)
+		}
+	}
+	if err := ioutil.WriteFile(wal.filename(4)+".tmp", []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first request of the restarted process is newer than the queue
+	wal, err = NewWAL(dir, DefaultWALMaxBytes)
+	if err != nil {
+		t.Fatalf("NewWAL() error: %+v", err)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmps) != 0 {
+		t.Errorf("stale %q are not removed", tmps)
+	}
+	if err := wal.Append(request(3)); err != nil {
+		t.Fatalf("Append() error: %+v", err)
+	}
+
+	receiver := &writeReceiver{received: make(chan struct{}, 16)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	if _, err := NewRemoteWriteSink(&RemoteWriteConfig{URL: server.URL, WALDir: dir}); err != nil {
+		t.Fatalf("NewRemoteWriteSink() error: %+v", err)
+	}
+
+	got := receiver.wait(t, 4)
+	want := [][]string{
+		{`__name__="up" 0 1600000000000`},
+		{`__name__="up" 1 1600000001000`},
+		{`__name__="up" 2 1600000002000`},
+		{`__name__="up" 3 1600000003000`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		seqs, err := wal.segments()
+		if err != nil {
+			t.Fatalf("segments() error: %+v", err)
+		}
+		if len(seqs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests are left in the wal", len(seqs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWALMaxBytes(t *testing.T) {
+	wal, err := NewWAL("", 10)
+	if err != nil {
+		t.Fatalf("NewWAL() error: %+v", err)
+	}
+
+	for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := wal.Append([]byte(s)); err != nil {
+			t.Fatalf("Append() error: %+v", err)
+		}
+	}
+
+	for _, want := range []string{"bbbb", "cccc", ""} {
+		seq, data, err := wal.Peek()
+		if err != nil {
+			t.Fatalf("Peek() error: %+v", err)
+		}
+		if string(data) != want {
+			t.Errorf("Peek() = %q, want %q", data, want)
+		}
+		if seq != 0 {
+			wal.Remove(seq)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v2"
+)
+
+// A secrets file is a yaml map of names to values, encrypted with a NaCl
+// secretbox and stored as base64 of nonce followed by the sealed box. The key
+// file holds the 32 bytes key in hex or base64.
+
+var expandRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func LoadSecretsKey(filename string) (*[32]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	s := strings.TrimSpace(string(data))
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("%s is not a 32 bytes hex or base64 key", filename)
+	}
+
+	key := new([32]byte)
+	copy(key[:], b)
+
+	return key, nil
+}
+
+// GenerateSecretsKey writes a new random key to filename which must not exist.
+func GenerateSecretsKey(filename string) (*[32]byte, error) {
+	key := new([32]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err = fmt.Fprintln(f, hex.EncodeToString(key[:])); err != nil {
+		return nil, err
+	}
+
+	return key, f.Close()
+}
+
+func EncryptSecrets(plaintext []byte, key *[32]byte) ([]byte, error) {
+	secrets := make(map[string]string)
+	if err := yaml.UnmarshalStrict(plaintext, &secrets); err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	box := secretbox.Seal(nonce[:], plaintext, &nonce, key)
+
+	return []byte(base64.StdEncoding.EncodeToString(box) + "\n"), nil
+}
+
+func DecryptSecrets(data []byte, key *[32]byte) (map[string]string, error) {
+	box, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(box) < 24+secretbox.Overhead {
+		return nil, errors.New("secrets file is too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], box)
+
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("unable to decrypt secrets file, wrong key?")
+	}
+
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// LoadSecrets decrypts the secrets file of the config if there is one.
+func (config *Config) LoadSecrets() error {
+	if config.SecretsFile == "" {
+		return nil
+	}
+
+	if config.SecretsKeyFile == "" {
+		return fmt.Errorf("secrets_file %s is set without secrets_key_file", config.SecretsFile)
+	}
+
+	key, err := LoadSecretsKey(config.SecretsKeyFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(config.SecretsFile)
+	if err != nil {
+		return err
+	}
+
+	config.secrets, err = DecryptSecrets(data, key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", config.SecretsFile, err)
+	}
+
+	return nil
+}
+
+// Expand replaces ${NAME} in s by the secret NAME, or the environment
+// variable NAME if there is no such secret. It is applied to the ssh host,
+// user, key, pass and pass_file of the entries only.
+func (config *Config) Expand(s string) (string, error) {
+	var err error
+	s = expandRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if value, ok := config.secrets[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			if config.envSecrets == nil {
+				config.envSecrets = make(map[string]bool)
+			}
+			config.envSecrets[name] = true
+			return value
+		}
+		if err == nil {
+			err = fmt.Errorf("%s is neither a secret nor an environment variable", ref)
+		}
+		return ""
+	})
+
+	return s, err
+}
+
+// Password returns the ssh password of an entry, read from passFile if set.
+func (config *Config) Password(pass, passFile string) (string, error) {
+	if passFile == "" {
+		return config.Expand(pass)
+	}
+
+	if pass != "" {
+		return "", errors.New("pass and pass_file are exclusive")
+	}
+
+	passFile, err := config.Expand(passFile)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(passFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
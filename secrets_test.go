@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSecretsRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "secrets.key")
+	key, err := GenerateSecretsKey(keyFile)
+	if err != nil {
+		t.Fatalf("GenerateSecretsKey() error: %+v", err)
+	}
+	if _, err := GenerateSecretsKey(keyFile); err == nil {
+		t.Errorf("GenerateSecretsKey() overwrote an existing key file")
+	}
+	if fi, err := os.Stat(keyFile); err != nil {
+		t.Errorf("os.Stat() error: %+v", err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode is %s, want 0600", fi.Mode())
+	}
+
+	loaded, err := LoadSecretsKey(keyFile)
+	if err != nil {
+		t.Fatalf("LoadSecretsKey() error: %+v", err)
+	}
+	if *loaded != *key {
+		t.Errorf("LoadSecretsKey() = %x, want %x", *loaded, *key)
+	}
+
+	data, err := EncryptSecrets([]byte("db_pass: s3cret\nweb_pass: \"p@ss: word\"\n"), key)
+	if err != nil {
+		t.Fatalf("EncryptSecrets() error: %+v", err)
+	}
+
+	secrets, err := DecryptSecrets(data, key)
+	if err != nil {
+		t.Fatalf("DecryptSecrets() error: %+v", err)
+	}
+	want := map[string]string{"db_pass": "s3cret", "web_pass": "p@ss: word"}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("DecryptSecrets() = %v, want %v", secrets, want)
+	}
+
+	other := *key
+	other[0] ^= 0xff
+	if _, err := DecryptSecrets(data, &other); err == nil {
+		t.Errorf("DecryptSecrets() opened the secrets with a wrong key")
+	}
+
+	if _, err := DecryptSecrets(data[:20], key); err == nil {
+		t.Errorf("DecryptSecrets() opened truncated secrets")
+	}
+
+	if _, err := EncryptSecrets([]byte("- not\n- a map\n"), key); err == nil {
+		t.Errorf("EncryptSecrets() accepted a yaml list")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	defer os.Unsetenv("REMOTE_NODE_EXPORTER_TEST_PASS")
+	os.Setenv("REMOTE_NODE_EXPORTER_TEST_PASS", "from-env")
+
+	config := &Config{secrets: map[string]string{"db_pass": "s3cret"}}
+
+	cases := []struct {
+		s    string
+		want string
+		err  bool
+	}{
+		{s: "root", want: "root"},
+		{s: "${db_pass}", want: "s3cret"},
+		{s: "a-${db_pass}-${REMOTE_NODE_EXPORTER_TEST_PASS}", want: "a-s3cret-from-env"},
+		{s: "$db_pass ${1x}", want: "$db_pass ${1x}"},
+		{s: "${REMOTE_NODE_EXPORTER_TEST_MISSING}", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := config.Expand(c.s)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("Expand(%#v) = %#v, %+v, want %#v", c.s, got, err, c.want)
+		}
+	}
+
+	// referenced environment variables are removed from the children
+	want := map[string]bool{"REMOTE_NODE_EXPORTER_TEST_PASS": true}
+	if !reflect.DeepEqual(config.envSecrets, want) {
+		t.Errorf("envSecrets = %v, want %v", config.envSecrets, want)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// Sink is a push output fed with the result of every successful background
+// collection.
+type Sink interface {
+	Name() string
+	Write(samples []Sample, ts time.Time) error
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a series of the text exposition format, Labels are sorted by
+// name and do not include __name__.
+type Sample struct {
+	Name   string
+	Type   string
+	Help   string
+	Labels []Label
+	Value  float64
+}
+
+// Label returns the value of the label name, or "" if there is none.
+func (s Sample) Label(name string) string {
+	for _, l := range s.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Family returns the metric family name of the sample, e.g. foo of
+// foo_bucket if foo is a histogram.
+func (s Sample) Family() string {
+	return metricFamily(s.Name, s.Type)
+}
+
+func metricFamily(name, typ string) string {
+	var suffixes []string
+	switch typ {
+	case "histogram":
+		suffixes = []string{"_bucket", "_sum", "_count"}
+	case "summary":
+		suffixes = []string{"_sum", "_count"}
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// ParseText parses the prometheus text exposition format produced by the
+// collectors, the TYPE and HELP of a sample are taken from its family.
+func ParseText(text string) ([]Sample, error) {
+	samples := make([]Sample, 0)
+	types := make(map[string]string)
+	helps := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '#' {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) == 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			if len(fields) == 4 && fields[1] == "HELP" {
+				helps[fields[2]] = strings.TrimSuffix(fields[3], ".")
+			}
+			continue
+		}
+
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		if typ, ok := types[s.Name]; ok {
+			s.Type = typ
+		} else {
+			for family, typ := range types {
+				if metricFamily(s.Name, typ) == family {
+					s.Type = typ
+					break
+				}
+			}
+		}
+		s.Help = helps[metricFamily(s.Name, s.Type)]
+
+		samples = append(samples, s)
+	}
+
+	return samples, scanner.Err()
+}
+
+func parseSample(line string) (Sample, error) {
+	var s Sample
+
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("invalid sample %#v", line)
+	}
+	s.Name = line[:i]
+	line = line[i:]
+
+	if line[0] == '{' {
+		line = line[1:]
+		for {
+			line = strings.TrimLeft(line, " ,")
+			if line == "" {
+				return s, fmt.Errorf("unterminated labels of %s", s.Name)
+			}
+			if line[0] == '}' {
+				line = line[1:]
+				break
+			}
+			j := strings.Index(line, "=\"")
+			if j <= 0 {
+				return s, fmt.Errorf("invalid labels of %s", s.Name)
+			}
+			name := strings.TrimSpace(line[:j])
+			line = line[j+2:]
+
+			var b strings.Builder
+			k := 0
+			for ; k < len(line) && line[k] != '"'; k++ {
+				if line[k] == '\\' && k+1 < len(line) {
+					k++
+					switch line[k] {
+					case 'n':
+						b.WriteByte('\n')
+					default:
+						b.WriteByte(line[k])
+					}
+					continue
+				}
+				b.WriteByte(line[k])
+			}
+			if k == len(line) {
+				return s, fmt.Errorf("unterminated label value of %s", s.Name)
+			}
+			line = line[k+1:]
+
+			s.Labels = append(s.Labels, Label{name, b.String()})
+		}
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("missing value of %s", s.Name)
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value of %s: %v", s.Name, err)
+	}
+	s.Value = value
+
+	// a label injected before the series own label of the same name is
+	// dropped, e.g. instance of an upstream exporter
+	sort.SliceStable(s.Labels, func(i, j int) bool {
+		return s.Labels[i].Name < s.Labels[j].Name
+	})
+	labels := s.Labels[:0]
+	for i, l := range s.Labels {
+		if i+1 < len(s.Labels) && s.Labels[i+1].Name == l.Name {
+			continue
+		}
+		labels = append(labels, l)
+	}
+	s.Labels = labels
+
+	return s, nil
+}
+
+// HTTPAuth is the authentication of a push output, secrets are read from
+// files so that they are not passed to the child process environment.
+type HTTPAuth struct {
+	BearerTokenFile string `yaml:"bearer_token_file" json:"bearer_token_file,omitempty"`
+	Username        string `yaml:"username" json:"username,omitempty"`
+	PasswordFile    string `yaml:"password_file" json:"password_file,omitempty"`
+}
+
+func (a HTTPAuth) Apply(req *http.Request) error {
+	if a.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(a.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	if a.Username != "" {
+		password, err := ioutil.ReadFile(a.PasswordFile)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(a.Username, strings.TrimRight(string(password), "\r\n"))
+	}
+
+	return nil
+}
+
+var sinkClient = &http.Client{Timeout: 30 * time.Second}
+
+// pushHTTP sends body to url and fails on non 2xx responses.
+func pushHTTP(method, url, contentType string, auth HTTPAuth, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if err := auth.Apply(req); err != nil {
+		return err
+	}
+
+	return doHTTP(req)
+}
+
+// doHTTP sends req and fails on non 2xx responses.
+func doHTTP(req *http.Request) error {
+	req.Header.Set("User-Agent", "remote_node_exporter")
+
+	resp, err := sinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL, resp.Status, bytes.TrimSpace(data))
+	}
+
+	return nil
+}
+
+// FormatText formats samples in the text exposition format, the samples of a
+// family are grouped under its HELP and TYPE and the labels in drop are
+// removed.
+func FormatText(samples []Sample, drop ...string) string {
+	families := make([]string, 0)
+	groups := make(map[string][]Sample)
+	for _, s := range samples {
+		family := s.Family()
+		if _, ok := groups[family]; !ok {
+			families = append(families, family)
+		}
+		groups[family] = append(groups[family], s)
+	}
+
+	var b bytes.Buffer
+	for _, family := range families {
+		first := groups[family][0]
+		if first.Help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s.\n", family, first.Help)
+		}
+		if first.Type != "" {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", family, first.Type)
+		}
+		for _, s := range groups[family] {
+			labels := make(map[string]string, len(s.Labels))
+			for _, l := range s.Labels {
+				labels[l.Name] = l.Value
+			}
+			for _, name := range drop {
+				delete(labels, name)
+			}
+			b.WriteString(s.Name)
+			if len(labels) > 0 {
+				b.WriteString("{" + FormatLabels(labels) + "}")
+			}
+			b.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+		}
+	}
+
+	return b.String()
+}
+
+// NewSinks returns the push outputs configured by the environment for the
+// target of client.
+func NewSinks(client *Client) ([]Sink, error) {
+	sinks := make([]Sink, 0)
+
+	if RemoteWrite != nil {
+		sink, err := NewRemoteWriteSink(RemoteWrite)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if Pushgateway != nil {
+		sinks = append(sinks, &PushgatewaySink{Config: Pushgateway})
+	}
+
+	if InfluxDB != nil {
+		sinks = append(sinks, NewInfluxDBSink(InfluxDB))
+	}
+
+	if Graphite != nil {
+		sinks = append(sinks, NewGraphiteSink(Graphite))
+	}
+
+	if StatsD != nil {
+		sinks = append(sinks, NewStatsDSink(StatsD))
+	}
+
+	if OTLP != nil {
+		sinks = append(sinks, NewOTLPSink(OTLP, client))
+	}
+
+	return sinks, nil
+}
+
+// PushLabels are added to every pushed sample, there is no prometheus target
+// to attach job and instance to pushed samples.
+func PushLabels() map[string]string {
+	labels := map[string]string{
+		"job":      "remote_node_exporter",
+		"instance": SshHost,
+	}
+	if LabelsMode != LabelsModeInfo {
+		for k, v := range Labels {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// WriteSinks parses body and writes it to all sinks in parallel.
+func WriteSinks(sinks []Sink, body string, ts time.Time) {
+	samples, err := ParseText(InjectLabels(body, FormatLabels(PushLabels())))
+	if err != nil {
+		log.Errorf("ParseText() error: %+v\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, sink := range sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			if err := sink.Write(samples, ts); err != nil {
+				log.Errorf("%s.Write() error: %+v\n", sink.Name(), err)
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
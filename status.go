@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// StatusFile is where a child writes its TargetStatus for the master.
+var StatusFile = os.Getenv("STATUS_FILE")
+
+var StatusInterval = 5 * time.Second
+
+var StartTime = time.Now()
+
+// TargetStatus is the connection and collection state of the target of a
+// child.
+type TargetStatus struct {
+	Target             string            `json:"target"`
+	State              string            `json:"state"`
+	Since              *time.Time        `json:"since,omitempty"`
+	LastError          string            `json:"last_error,omitempty"`
+	RTT                float64           `json:"rtt_seconds,omitempty"`
+	LastScrape         *time.Time        `json:"last_scrape,omitempty"`
+	LastScrapeDuration float64           `json:"last_scrape_duration_seconds,omitempty"`
+	LastScrapeError    string            `json:"last_scrape_error,omitempty"`
+	Collectors         []CollectorStatus `json:"collectors,omitempty"`
+	Uname              map[string]string `json:"uname,omitempty"`
+	TimeOffset         string            `json:"time_offset,omitempty"`
+	Capabilities       map[string]bool   `json:"capabilities,omitempty"`
+}
+
+type CollectorStatus struct {
+	Name          string     `json:"name"`
+	LastRun       *time.Time `json:"last_run,omitempty"`
+	Duration      float64    `json:"duration_seconds"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// clientStatus is the part of TargetStatus kept by a Client.
+type clientStatus struct {
+	connected    bool
+	since        time.Time
+	lastError    string
+	scraped      time.Time
+	duration     time.Duration
+	scrapeError  string
+	collectors   map[string]CollectorStatus
+	uname        map[string]string
+	timeOffset   time.Duration
+	capabilities map[string]bool
+}
+
+// setConnected records a connection or its failure, it must be called with
+// c.mu held.
+func (c *Client) setConnected(err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	s := &c.status
+	if s.connected != (err == nil) || s.since.IsZero() {
+		s.since = time.Now()
+	}
+	s.connected = err == nil
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+
+	s.uname = c.uname
+	s.timeOffset = c.timeOffset
+	s.capabilities = map[string]bool{
+		"timeout":    c.hasTimeout,
+		"os_release": len(c.osRelease) > 0,
+		"dmi":        len(c.dmi) > 0,
+		"machine_id": c.machineID != "",
+	}
+}
+
+func (c *Client) recordScrape(start time.Time, err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	c.status.scraped = start
+	c.status.duration = time.Since(start)
+	c.status.scrapeError = ""
+	if err != nil {
+		c.status.scrapeError = err.Error()
+	}
+}
+
+func (c *Client) recordCollector(name string, start time.Time, err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	if c.status.collectors == nil {
+		c.status.collectors = make(map[string]CollectorStatus)
+	}
+
+	s := c.status.collectors[name]
+	s.Name = name
+	s.LastRun = &start
+	s.Duration = time.Since(start).Seconds()
+	// the error is of the last run only
+	s.LastError, s.LastErrorTime = "", nil
+	if err != nil {
+		s.LastError = err.Error()
+		s.LastErrorTime = &start
+	}
+	c.status.collectors[name] = s
+}
+
+// Uname returns the uname of the target recorded by the last connection, it
+// is nil before the first one.
+func (c *Client) Uname() map[string]string {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	return c.status.uname
+}
+
+// Ready reports whether the ssh connection is established.
+func (c *Client) Ready() bool {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	return c.status.connected
+}
+
+func (c *Client) Status() TargetStatus {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	s := c.status
+	status := TargetStatus{
+		Target:       SshUser + "@" + c.Addr,
+		State:        "connecting",
+		LastError:    s.lastError,
+		RTT:          c.RTT().Seconds(),
+		Uname:        s.uname,
+		Capabilities: s.capabilities,
+	}
+
+	if !s.since.IsZero() {
+		status.State = "disconnected"
+		if s.connected {
+			status.State = "connected"
+		}
+		since := s.since
+		status.Since = &since
+	}
+
+	if !s.scraped.IsZero() {
+		scraped := s.scraped
+		status.LastScrape = &scraped
+		status.LastScrapeDuration = s.duration.Seconds()
+		status.LastScrapeError = s.scrapeError
+	}
+
+	if s.uname != nil {
+		status.TimeOffset = s.timeOffset.String()
+	}
+
+	for _, collector := range Collectors {
+		if cs, ok := s.collectors[collector.Name]; ok {
+			status.Collectors = append(status.Collectors, cs)
+		}
+	}
+
+	return status
+}
+
+// WriteStatus writes the status of client to filename every StatusInterval
+// if it changed.
+func WriteStatus(client *Client, filename string) {
+	var last []byte
+	for {
+		data, err := json.Marshal(client.Status())
+		if err == nil && !bytes.Equal(data, last) {
+			if err = ioutil.WriteFile(filename+".tmp", data, 0600); err == nil {
+				err = os.Rename(filename+".tmp", filename)
+			}
+			if err != nil {
+				log.Errorf("write %s error: %+v\n", filename, err)
+			} else {
+				last = data
+			}
+		}
+		time.Sleep(StatusInterval)
+	}
+}
+
+// ReadStatus reads the status written by a child, it returns nil if there
+// is none yet.
+func ReadStatus(filename string) *TargetStatus {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	status := &TargetStatus{}
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil
+	}
+
+	return status
+}
+
+func HandleHealthy(rw http.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("Healthy.\n"))
+}
+
+// HandleReady returns 200 once the ssh connection is established.
+func HandleReady(client *Client) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !client.Ready() {
+			http.Error(rw, "Not ready, ssh is "+client.Status().State+".", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("Ready.\n"))
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return time.Since(*t).Truncate(time.Second).String() + " ago"
+	},
+	"seconds": func(f float64) string {
+		return time.Duration(f * float64(time.Second)).Round(time.Millisecond).String()
+	},
+	"keys": func(m map[string]string) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+}).Parse(`<html>
+<head><title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+.connected, .running { color: green; }
+.disconnected, .restarting, .error { color: red; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{range .Links}}<a href="{{.}}">{{.}}</a> {{end}}</p>
+{{range .Children}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>process</th><td class="{{.State}}">{{.State}}{{if .Pid}} pid {{.Pid}} started {{ago .Started}}{{end}}, {{.Restarts}} restarts{{if .Exit}}, last exit {{.Exit}} {{ago .ExitTime}}{{end}}</td></tr>
+{{with .Target}}
+<tr><th>ssh</th><td class="{{.State}}">{{.Target}} {{.State}} {{if .Since}}since {{ago .Since}}{{end}}{{if .RTT}}, rtt {{seconds .RTT}}{{end}}</td></tr>
+{{if .LastError}}<tr><th>last error</th><td class="error">{{.LastError}}</td></tr>{{end}}
+<tr><th>last scrape</th><td>{{ago .LastScrape}}{{if .LastScrape}} in {{seconds .LastScrapeDuration}}{{end}}{{if .LastScrapeError}} <span class="error">{{.LastScrapeError}}</span>{{end}}</td></tr>
+{{if .Uname}}<tr><th>uname</th><td>{{$u := .Uname}}{{range keys .Uname}}{{.}}={{index $u .}} {{end}}</td></tr>{{end}}
+{{if .TimeOffset}}<tr><th>time offset</th><td>{{.TimeOffset}}</td></tr>{{end}}
+{{if .Capabilities}}<tr><th>capabilities</th><td>{{range $k, $v := .Capabilities}}{{$k}}={{$v}} {{end}}</td></tr>{{end}}
+</table>
+{{if .Collectors}}
+<table>
+<tr><th>collector</th><th>last run</th><th>duration</th><th>last error</th></tr>
+{{range .Collectors}}<tr><td>{{.Name}}</td><td>{{ago .LastRun}}</td><td>{{seconds .Duration}}</td><td class="error">{{if .LastError}}{{.LastError}} ({{ago .LastErrorTime}}){{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{else}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// WriteStatusPage renders the status of children as html, the json of the
+// same status is served at /-/status.
+func WriteStatusPage(rw http.ResponseWriter, req *http.Request, title string, links []string, status []ChildStatus) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := statusTemplate.Execute(rw, struct {
+		Title    string
+		Links    []string
+		Children []ChildStatus
+	}{title, links, status})
+	if err != nil {
+		log.Errorf("statusTemplate.Execute() error: %+v\n", err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/common/log"
+)
+
+var (
+	WebConfigFile = os.Getenv("WEB_CONFIG_FILE")
+	ListenHost    = os.Getenv("LISTEN_HOST")
+)
+
+// WebConfig is the prometheus exporter-toolkit web config file, with
+// bearer_tokens in addition. Passwords and tokens are bcrypt hashes.
+// https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+type WebConfig struct {
+	TLSServerConfig  *WebTLSConfig `yaml:"tls_server_config"`
+	HTTPServerConfig struct {
+		HTTP2   *bool             `yaml:"http2"`
+		Headers map[string]string `yaml:"headers"`
+	} `yaml:"http_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	BearerTokens   []string          `yaml:"bearer_tokens"`
+}
+
+type WebTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuthType           string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites *bool    `yaml:"prefer_server_cipher_suites"`
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+	tlsClientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+)
+
+// LoadWebConfig reads and validates a web config file.
+func LoadWebConfig(filename string) (*WebConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &WebConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("basic_auth_users.%s: %v", user, err)
+		}
+	}
+	for i, hash := range config.BearerTokens {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("bearer_tokens[%d]: %v", i, err)
+		}
+	}
+
+	if config.TLSServerConfig != nil {
+		if _, err := config.TLSServerConfig.TLSConfig(); err != nil {
+			return nil, fmt.Errorf("tls_server_config: %v", err)
+		}
+	}
+
+	return config, nil
+}
+
+// HTTP2 reports whether http2 is enabled, which is the default.
+func (config *WebConfig) HTTP2() bool {
+	return config.HTTPServerConfig.HTTP2 == nil || *config.HTTPServerConfig.HTTP2
+}
+
+func (c *WebTLSConfig) TLSConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		if config.MinVersion = tlsVersions[c.MinVersion]; config.MinVersion == 0 {
+			return nil, fmt.Errorf("unknown min_version %#v", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		if config.MaxVersion = tlsVersions[c.MaxVersion]; config.MaxVersion == 0 {
+			return nil, fmt.Errorf("unknown max_version %#v", c.MaxVersion)
+		}
+	}
+
+	clientAuth, ok := tlsClientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %#v", c.ClientAuthType)
+	}
+	config.ClientAuth = clientAuth
+
+	if c.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in client_ca_file %s", c.ClientCAFile)
+		}
+	}
+	if (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) && config.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuthType)
+	}
+
+	for _, name := range c.CipherSuites {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				config.CipherSuites = append(config.CipherSuites, suite.ID)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %#v", name)
+		}
+	}
+
+	for _, name := range c.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %#v", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if c.PreferServerCipherSuites != nil {
+		config.PreferServerCipherSuites = *c.PreferServerCipherSuites
+	}
+
+	return config, nil
+}
+
+// WebServer serves handler with the authentication and headers of the web
+// config file, which is reloaded with its certificates when they change so
+// that rotated certificates and changed users are picked up without restart.
+type WebServer struct {
+	Filename string
+	Handler  http.Handler
+
+	stamp  string
+	config *WebConfig
+	tls    *tls.Config
+	cache  map[[32]byte]bool
+	mu     sync.Mutex
+}
+
+// fileStamp returns the modification times and sizes of files.
+func fileStamp(filenames ...string) string {
+	var b strings.Builder
+	for _, filename := range filenames {
+		if fi, err := os.Stat(filename); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d,", filename, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return b.String()
+}
+
+func (w *WebServer) load() (*WebConfig, *tls.Config, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := []string{w.Filename}
+	if c := w.config; c != nil && c.TLSServerConfig != nil {
+		files = append(files, c.TLSServerConfig.CertFile, c.TLSServerConfig.KeyFile, c.TLSServerConfig.ClientCAFile)
+	}
+	stamp := fileStamp(files...)
+	if w.config != nil && stamp == w.stamp {
+		return w.config, w.tls, nil
+	}
+
+	var tlsConfig *tls.Config
+	config, err := LoadWebConfig(w.Filename)
+	if err == nil && config.TLSServerConfig != nil {
+		tlsConfig, err = config.TLSServerConfig.TLSConfig()
+	}
+	if err != nil {
+		if w.config == nil {
+			return nil, nil, err
+		}
+		// keep serving with the previous config
+		log.Errorf("LoadWebConfig(%#v) error: %+v\n", w.Filename, err)
+		w.stamp = stamp
+		return w.config, w.tls, nil
+	}
+
+	if tlsConfig != nil && config.HTTP2() {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	w.stamp = stamp
+	w.config = config
+	w.tls = tlsConfig
+	w.cache = make(map[[32]byte]bool)
+
+	return w.config, w.tls, nil
+}
+
+var (
+	webDummyHash     []byte
+	webDummyHashOnce sync.Once
+)
+
+// verify compares secret with a bcrypt hash, successful comparisons are
+// cached as bcrypt is slow by design.
+func (w *WebServer) verify(hash, secret string) bool {
+	key := sha256.Sum256([]byte(hash + "\x00" + secret))
+
+	w.mu.Lock()
+	ok := w.cache[key]
+	w.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		return false
+	}
+
+	w.mu.Lock()
+	w.cache[key] = true
+	w.mu.Unlock()
+
+	return true
+}
+
+func (w *WebServer) authorized(config *WebConfig, req *http.Request) bool {
+	if len(config.BasicAuthUsers) == 0 && len(config.BearerTokens) == 0 {
+		return true
+	}
+
+	if user, pass, ok := req.BasicAuth(); ok {
+		hash, ok := config.BasicAuthUsers[user]
+		if !ok {
+			// unknown users take as long as wrong passwords
+			webDummyHashOnce.Do(func() {
+				webDummyHash, _ = bcrypt.GenerateFromPassword([]byte("remote_node_exporter"), bcrypt.DefaultCost)
+			})
+			bcrypt.CompareHashAndPassword(webDummyHash, []byte(pass))
+			return false
+		}
+		return w.verify(hash, pass)
+	}
+
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		for _, hash := range config.BearerTokens {
+			if w.verify(hash, token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (w *WebServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	config, _, err := w.load()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for name, value := range config.HTTPServerConfig.Headers {
+		rw.Header().Set(name, value)
+	}
+
+	if !w.authorized(config, req) {
+		if len(config.BasicAuthUsers) > 0 {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="remote_node_exporter"`)
+		}
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	w.Handler.ServeHTTP(rw, req)
+}
+
+// ListenAndServeWeb serves handler on addr with the web config file if set,
+// over TLS if it has a tls_server_config.
+func ListenAndServeWeb(addr string, handler http.Handler) error {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+
+	if WebConfigFile == "" {
+		return http.ListenAndServe(addr, handler)
+	}
+
+	w := &WebServer{Filename: WebConfigFile, Handler: handler}
+	config, _, err := w.load()
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Addr: addr, Handler: w}
+	if config.TLSServerConfig == nil {
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, config, err := w.load()
+			return config, err
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			_, config, err := w.load()
+			if err == nil && config == nil {
+				err = errors.New("tls_server_config is removed")
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &config.Certificates[0], nil
+		},
+	}
+	if !config.HTTP2() {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	return server.ListenAndServeTLS("", "")
+}
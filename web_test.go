@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWebServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pass, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := bcrypt.GenerateFromPassword([]byte("t0ken"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "web.yml")
+	config := "basic_auth_users:\n  alice: " + string(pass) + "\n" +
+		"bearer_tokens:\n  - " + string(token) + "\n" +
+		"http_server_config:\n  headers:\n    X-Frame-Options: deny\n"
+	if err := ioutil.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(&WebServer{
+		Filename: filename,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("ok"))
+		}),
+	})
+	defer server.Close()
+
+	cases := []struct {
+		name   string
+		auth   func(req *http.Request)
+		status int
+	}{
+		{"no auth", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"basic", func(req *http.Request) { req.SetBasicAuth("alice", "s3cret") }, http.StatusOK},
+		{"basic cached", func(req *http.Request) { req.SetBasicAuth("alice", "s3cret") }, http.StatusOK},
+		{"wrong password", func(req *http.Request) { req.SetBasicAuth("alice", "secret") }, http.StatusUnauthorized},
+		{"unknown user", func(req *http.Request) { req.SetBasicAuth("bob", "s3cret") }, http.StatusUnauthorized},
+		{"bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK},
+		{"wrong bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer token") }, http.StatusUnauthorized},
+		{"password as bearer", func(req *http.Request) { req.Header.Set("Authorization", "Bearer s3cret") }, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.auth(req)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET error: %+v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != c.status {
+				t.Errorf("GET status = %d, want %d", resp.StatusCode, c.status)
+			}
+			if got := resp.Header.Get("X-Frame-Options"); got != "deny" {
+				t.Errorf("X-Frame-Options = %#v, want \"deny\"", got)
+			}
+			if got := resp.Header.Get("WWW-Authenticate"); (got != "") != (c.status == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %#v with status %d", got, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	files := "  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n"
+
+	cases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "tls",
+			config: "tls_server_config:\n" + files + "  min_version: TLS13\n  client_auth_type: RequireAndVerifyClientCert\n  client_ca_file: " + certFile + "\n  curve_preferences: [X25519]\n",
+		},
+		{
+			name:   "no key_file",
+			config: "tls_server_config:\n  cert_file: " + certFile + "\n",
+			err:    "tls_server_config: cert_file and key_file are required",
+		},
+		{
+			name:   "unknown min_version",
+			config: "tls_server_config:\n" + files + "  min_version: TLS14\n",
+			err:    `tls_server_config: unknown min_version "TLS14"`,
+		},
+		{
+			name:   "no client_ca_file",
+			config: "tls_server_config:\n" + files + "  client_auth_type: RequireAndVerifyClientCert\n",
+			err:    "tls_server_config: client_auth_type RequireAndVerifyClientCert requires client_ca_file",
+		},
+		{
+			name:   "unknown cipher suite",
+			config: "tls_server_config:\n" + files + "  cipher_suites: [TLS_RSA_WITH_RC4_128_MD5]\n",
+			err:    `tls_server_config: unknown cipher suite "TLS_RSA_WITH_RC4_128_MD5"`,
+		},
+		{
+			name:   "plain password",
+			config: "basic_auth_users:\n  alice: s3cret\n",
+			err:    "basic_auth_users.alice: ",
+		},
+		{
+			name:   "unknown field",
+			config: "basic_auth_user:\n  alice: s3cret\n",
+			err:    "field basic_auth_user not found",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "web.yml")
+			if err := ioutil.WriteFile(filename, []byte(c.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadWebConfig(filename)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("LoadWebConfig() error = %v, want %#v", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadWebConfig() error: %+v", err)
+			}
+
+			tlsConfig, err := config.TLSServerConfig.TLSConfig()
+			if err != nil {
+				t.Fatalf("TLSConfig() error: %+v", err)
+			}
+			if tlsConfig.MinVersion != tls.VersionTLS13 || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+				t.Errorf("TLSConfig() = %+v", tlsConfig)
+			}
+			if len(tlsConfig.CurvePreferences) != 1 || tlsConfig.CurvePreferences[0] != tls.X25519 {
+				t.Errorf("TLSConfig().CurvePreferences = %v, want [X25519]", tlsConfig.CurvePreferences)
+			}
+			if !config.HTTP2() {
+				t.Errorf("HTTP2() = false, want the default true")
+			}
+		})
+	}
+}
+
+func TestWebServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_node_exporter_web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir)
+	filename := filepath.Join(dir, "web.yml")
+	config := "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n"
+	if err := ioutil.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &WebServer{
+		Filename: filename,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("ok"))
+		}),
+	}
+	_, tlsConfig, err := w.load()
+	if err != nil {
+		t.Fatalf("load() error: %+v", err)
+	}
+
+	server := httptest.NewUnstartedServer(w)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(data)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET error: %+v", err)
+	}
+	defer resp.Body.Close()
+	if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(b) != "ok" {
+		t.Errorf("GET = %d %q, want 200 \"ok\"", resp.StatusCode, b)
+	}
+}